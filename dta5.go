@@ -5,9 +5,13 @@
 //
 package main
 
-import( "bufio"; "encoding/json"; "flag"; "fmt"; "io"; "io/ioutil";
-        "log"; "net"; "os"; "regexp"; "strings";
+import( "bufio"; "encoding/base64"; "encoding/binary"; "encoding/json"; "flag";
+        "fmt"; "hash/fnv"; "html"; "io"; "io/ioutil"; "log"; "net"; "os";
+        "path/filepath"; "regexp"; "sort"; "strconv"; "strings"; "time";
+        "unicode/utf8";
         "github.com/nsf/termbox-go";
+        "github.com/mattn/go-runewidth";
+        "golang.org/x/text/unicode/norm";
         "github.com/d2718/dconfig";
 )
 
@@ -29,6 +33,24 @@ var EchoFg     = termbox.ColorYellow
 var EchoBg     = termbox.ColorBlack
 var SysFg      = termbox.ColorMagenta
 var SysBg      = termbox.ColorBlack
+var GagFg      = termbox.ColorCyan
+var GagBg      = termbox.ColorBlack
+// Colors of text marked up by the server as items or players. (See
+// (*SGRState) Tag().) These only set the foreground; the background is
+// whatever the surrounding text's is.
+var ItemFg     = termbox.ColorLightBlue
+var PlayerFg   = termbox.ColorLightCyan
+// Color of the timestamps shown beside the game text.
+var TimeFg     = termbox.ColorDarkGray
+// Whether to use the terminal's 256-color mode: "256", "16", or "auto" (use
+// it if $TERM or $COLORTERM suggest the terminal supports it). Use256 is
+// set from this by Config().
+var ColorMode = "auto"
+var Use256    = false
+// Name of the color theme to use (see LoadTheme()), and the directory where
+// theme files are kept.
+var Theme     = ""
+var ThemeDir  = "themes"
 // Whether a blank line should be inserted before echoed commands to
 // increase readability.
 var SkipAfterSend = true
@@ -43,9 +65,63 @@ var Pwd   = ""
 var MaxScrollbackLines = 512
 // Number of most recent lines to keep when scrollback history is being trimmed.
 var MinScrollbackLines = 256
+// Whether Lines trimmed from the scrollback history get written to a file
+// (so the history can still be scrolled back through all the way to the
+// beginning of the session) instead of being discarded, where that file goes
+// (a "scrollback" directory under DataDir() if this is empty), and whether
+// it's kept after the client exits.
+var StoreScrollback = true
+var ScrollbackDir   = ""
+var KeepScrollback  = false
 // When scrolling the game window history back (and forward), the number of
 // rows of text adjacent screens should have in common.
 var ScrollbackOverlap = 2
+// Whether each Line's Time is shown in a gutter to the left of the game
+// text, and how (as a layout for Go's time.Format(); "15:04" is hours and
+// minutes).
+var ShowTimestamps  = false
+var TimestampFormat = "15:04"
+// Where the chat pane goes ("top", "right", or "off"), how many rows or
+// columns (respectively) it takes up, whether walls go to it as well as
+// speech, and whether speech also stays in the game window.
+var ChatPosition = "off"
+var ChatHeight   = 8
+var ChatWidth    = 40
+var ChatWall     = false
+var ChatInMain   = true
+// What to do (a list of alert actions, as in an ALERT rule; blank for
+// nothing) when your character's name turns up in game text, how many
+// seconds an alert stays quiet after going off (unless its rule says
+// otherwise), which escape sequence(s) ask the terminal for a desktop
+// notification ("9", "777", or "both"), and how many milliseconds a flash of
+// the Head Line lasts.
+var AlertOnName   = "bell, flash"
+var AlertInterval = 30
+var NotifyEscape  = "777"
+var AlertFlashMs  = 500
+// What the terminal's title is set to, with {char} replaced by your
+// character's name and {room} by what's in the Head Line (usually where you
+// are). Blank leaves the title alone.
+var TitleFormat = "dta5 – {char} – {room}"
+// Whether the game window should be split while it's scrolled back, with
+// the newest SplitRows rows still shown at the bottom.
+var SplitView = true
+var SplitRows = 8
+// Whether rows after the first of a wrapped Line should be indented as far
+// as the Line itself is, and how many more columns than that they should be
+// indented.
+var PreserveIndent = true
+var HangingIndent  = 0
+// Indentation of wrapped rows is dropped rather than leave them fewer than
+// this many columns wide.
+const MinWrapCols = 10
+// Distance between tab stops.
+var TabWidth = 8
+// Maximum width (in columns) of game text; 0 means the whole width of the
+// window. If the window is wider than this, the text is placed at the left
+// edge of the window, or in the center if CenterText is true.
+var MaxTextWidth = 0
+var CenterText   = false
 // Number of remembered commands that triggers the command history to be
 // trimmed.
 var MaxCmdHistSize     = 128
@@ -55,9 +131,25 @@ var MinCmdHistSize     = 64
 var MinCmdLen int = 3
 
 var DefaultCfgFile = "dta5.conf"
+// File holding gag, substitution, and other rules. See ReadRules(), below.
+var RulesFile = "dta5.rules"
+// Number of most recently gagged lines to remember, so they can be revealed
+// with ToggleGagged().
+var GagMemory = 64
 // Used by ProcessEnvelope() to add color to the first part of lines of
-// dialog (so they stand out).
-var SpeechRe = regexp.MustCompile(`^[^"]+ (says?|asks?|exclaims?)[^"]+`)
+// dialog (so they stand out). Built by BuildSpeechRe() from SpeechVerbs,
+// unless SpeechPattern is set. The part of the match in the group named
+// "speaker" (SpeakerGroup) gets colored according to who is speaking.
+var SpeechRe = regexp.MustCompile(`^(?P<speaker>[^"]+?) (?:says?|asks?|exclaims?)\b[^"]*`)
+var SpeakerGroup = 1
+var SpeechVerbs = "say, ask, exclaim, whisper, shout, yell"
+var SpeechPattern = ""
+// Whether to give each speaker their own color from SpeakerPalette (unless
+// they have been assigned one with a SPEAKER rule).
+var ColorSpeakers = true
+var SpeakerPalette = "green, cyan, magenta, yellow, bright green, bright cyan, bright magenta, bright yellow, bright blue, bright red"
+var SpeakerColors = []termbox.Attribute{}
+var SpeakerOverrides = make(map[string]termbox.Attribute)
 var NewsFile = "fe_news.txt"
 var LogFileName  = "termfe.log"
 var LogFile *os.File
@@ -69,7 +161,8 @@ var EventChanSize = 16
 // The CharClass type is used by the line wrapping algorithm to help
 // identify where text should be wrapped. "Breaking" characters are characters
 // that can be wrapped directly after, even in the middle of a word (so far
-// just '-', '/', '_').
+// just '-', '/', '_', and double-width characters, since CJK text doesn't
+// put spaces between words).
 //
 type CharClass int
 
@@ -89,13 +182,51 @@ type Cell termbox.Cell
 func (c Cell) Class() CharClass {
   if c.Ch < 33 {
     return Whitespace
-  } else if BreakingChars[c.Ch] {
+  } else if BreakingChars[c.Ch] || RuneCols(c.Ch) == 2 {
     return Breaking
   } else {
     return Normal
   }
 }
 
+// RuneCols() returns the number of terminal columns termbox will use to
+// display the given rune: 2 for "wide" characters (most CJK characters and
+// emoji), 1 for everything else. (termbox displays zero-width characters
+// and ambiguous-width characters in one column, so we have to, too.)
+//
+func RuneCols(r rune) int {
+  if runewidth.RuneWidth(r) == 2 && !runewidth.IsAmbiguousWidth(r) {
+    return 2
+  }
+  return 1
+}
+
+// Returns the number of terminal columns the given Cells will occupy.
+//
+func CellCols(cellz []Cell) int {
+  var cols int = 0
+  for _, c := range cellz {
+    cols = cols + RuneCols(c.Ch)
+  }
+  return cols
+}
+
+// Draws the given Cells on row y of the terminal, starting at column x and
+// stopping before any Cell that wouldn't fit before column max_x. Returns the
+// column after the last Cell drawn.
+//
+func DrawCells(cellz []Cell, x, y, max_x int) int {
+  for _, c := range cellz {
+    w := RuneCols(c.Ch)
+    if x + w > max_x {
+      break
+    }
+    termbox.SetCell(x, y, c.Ch, c.Fg, c.Bg)
+    x = x + w
+  }
+  return x
+}
+
 // A Line represents a single newline-terminated "line" of text in the
 // game window. If it is longer than the window is wide, it will be wrapped
 // and occupy more than a single row of characters on the terminal window.
@@ -108,11 +239,30 @@ func (c Cell) Class() CharClass {
 // The Width field stores the window width for which the Line was wrapped,
 // so that it only needs to be re-wrapped if the window width changes.
 //
+// Indent is the number of blank columns that precede every row after the
+// first (the first row's indentation is just part of the Line's text).
+//
+// A Pre ("preformatted") Line is never wrapped; it always occupies a single
+// row, and whatever doesn't fit in the window is cut off (but the game
+// window can be scrolled horizontally to see it; see HScroll).
+//
+// Time is when the Line was added to the game window (see AddLine()), and
+// Type the type of Env it arrived in ("" for text from the client itself).
+//
+// A Line with Marker set is the first one that arrived while the game
+// window was scrolled back; it's drawn with an extra row above it marking
+// where the unread text begins (see UnreadFrom).
+//
 type Line struct {
   C      []Cell
   Width  int
   Starts []int
   Ends   []int
+  Indent int
+  Pre    bool
+  Time   time.Time
+  Type   string
+  Marker bool
 }
 
 // This is only really used for debugging and logging.
@@ -136,6 +286,35 @@ func (l Line) Len() int {
   }
 }
 
+// (*Line) Copy() returns a copy of the Line (not yet wrapped) whose Cells
+// can be changed without affecting the original.
+//
+func (l *Line) Copy() *Line {
+  c := make([]Cell, len(l.C))
+  copy(c, l.C)
+  return &Line{ C: c, Width: -1, Pre: l.Pre, Time: l.Time, Type: l.Type }
+}
+
+// Returns the index of the first Cell after pos that won't fit in a row of
+// the given width starting at pos. At least one Cell always "fits", so
+// wrapping can't get stuck on a double-width character in a one-column row.
+//
+func (l *Line) fitCells(pos, width int) int {
+  var cols int = 0
+  n := pos
+  for n < len(l.C) {
+    cols = cols + RuneCols(l.C[n].Ch)
+    if cols > width {
+      break
+    }
+    n++
+  }
+  if n == pos && n < len(l.C) {
+    n++
+  }
+  return n
+}
+
 // Return the next index after pos where the Line could break.
 //
 func (l *Line) nextWordEnd(pos int) int {
@@ -167,49 +346,92 @@ func (l *Line) nextWordStart(pos int) int {
 // where each row of text should begin and end. This information is then used
 // by DrawScrollBack() (below) when writing characters to the game window.
 //
+// Widths are measured in terminal columns, not Cells, because double-width
+// characters take up two columns.
+//
+// Whitespace is trimmed from the beginning of each row, except (if
+// PreserveIndent is true) the first, and the rest of the rows are indented
+// to match it, plus HangingIndent. Indentation is limited to half the width,
+// and dropped entirely if it would leave rows narrower than MinWrapCols, so
+// there's always some room for text.
+//
 func (l *Line) Wrap(width int) {
   
   log.Println("(*Line).Wrap() called... (", l.String(), ")")
   
+  if l.Pre {
+    l.Starts = []int{ 0 }
+    l.Ends   = []int{ len(l.C) }
+    l.Width  = width
+    l.Indent = 0
+    return
+  }
+  
   var c_idx int = 0
   var fence int = len(l.C)
   var starts []int = make([]int, 0, 1)
   var ends   []int = make([]int, 0, 0)
   
-  var t, adv, l_idx int
+  var t, adv, l_idx, row_w int
+  
+  var indent int = HangingIndent
+  var keep_lead bool = false
+  if PreserveIndent {
+    lead := CellCols(l.C[:l.nextWordStart(0)])
+    indent = indent + lead
+    keep_lead = width - lead >= MinWrapCols
+  }
+  if indent > width / 2 {
+    indent = width / 2
+  }
+  if width - indent < MinWrapCols {
+    indent = 0
+  }
   
   pre_start:
   // trim any whitespace before beginning the next line
   t = l.nextWordStart(c_idx)
   if t == fence { goto end }
-  starts = append(starts, t)
+  if len(starts) == 0 {
+    row_w = width
+    if keep_lead {
+      starts = append(starts, 0)
+      l_idx = CellCols(l.C[:t])
+    } else {
+      starts = append(starts, t)
+      l_idx = 0
+    }
+  } else {
+    starts = append(starts, t)
+    row_w = width - indent
+    l_idx = 0
+  }
   c_idx = t
-  l_idx = 0
   
   //start:
   // Check to see if the current word is too long for the line; if so,
   // break the word at the terminal width.
   t = l.nextWordEnd(c_idx)
-  adv = t - c_idx
-  if adv >= width {
-    c_idx = c_idx + width
+  adv = CellCols(l.C[c_idx:t])
+  if l_idx + adv >= row_w {
+    c_idx = l.fitCells(c_idx, row_w - l_idx)
     ends = append(ends, c_idx)
     goto pre_start
   }
   l_idx = l_idx + adv
-  c_idx = c_idx + adv
+  c_idx = t
   
   word_end:
   // Check to see if the next breakable spot is beyond the end of the line;
   // if so, wrap now.
   t = l.nextWordEnd(l.nextWordStart(c_idx))
-  adv = t - c_idx
+  adv = CellCols(l.C[c_idx:t])
   l_idx = l_idx + adv
-  if l_idx >= width {
+  if l_idx >= row_w {
     ends = append(ends, c_idx)
     goto pre_start
   }
-  c_idx = c_idx + adv
+  c_idx = t
   if c_idx == fence {
     ends = append(ends, c_idx)
     goto end
@@ -224,47 +446,464 @@ func (l *Line) Wrap(width int) {
   l.Starts = starts
   l.Ends   = ends
   l.Width  = width
+  l.Indent = indent
   
   log.Println("Starts, Ends, Width:", l.Starts, l.Ends, l.Width)
   log.Println("...(*Line) Wrap() ends")
   
 }
 
-// Returns a new *Line with the given text and attributes.
+// Returns a new *Line with the given text and attributes. Any ANSI escape
+// sequences in the text are interpreted (see SGRState, below).
 //
 func NewLine(text string, fg, bg termbox.Attribute) *Line {
-  cellz := make([]Cell, 0, len(text))
-  for _, ch := range text {
-    cellz = append(cellz, Cell{ Ch: ch, Fg: fg, Bg: bg, })
+  return NewSGRState(fg, bg).NewLine(text)
+}
+
+// Appends the given text with the supplied attributes to the receiving *Line.
+//
+func (l *Line) Add(text string, fg, bg termbox.Attribute) {
+  l.C = NewSGRState(fg, bg).Append(l.C, text)
+  l.Width = -1
+  l.Starts = nil
+  l.Ends = nil
+}
+
+// (*Line) Colorize() sets the colors of the Cells from start up to (but not
+// including) end, except for Cells that aren't in the given "plain" colors,
+// which have presumably been colored on purpose and are left alone.
+//
+func (l *Line) Colorize(start, end int, plain_fg, plain_bg,
+                        fg, bg termbox.Attribute) {
+  if end > len(l.C) {
+    end = len(l.C)
+  }
+  for n := start; n < end; n++ {
+    if l.C[n].Fg == plain_fg && l.C[n].Bg == plain_bg {
+      l.C[n].Fg, l.C[n].Bg = fg, bg
+    }
+  }
+}
+
+// All the attributes that aren't colors.
+var AttrMask termbox.Attribute = termbox.AttrBold | termbox.AttrBlink |
+                                 termbox.AttrHidden | termbox.AttrDim |
+                                 termbox.AttrUnderline | termbox.AttrCursive |
+                                 termbox.AttrReverse
+
+// An SGRState keeps track of the colors and attributes set by ANSI "Select
+// Graphic Rendition" escape sequences ("\x1b[...m") as text containing them
+// is turned into Cells. It starts with (and resets to) the base colors it
+// was created with. Because the server might set colors on one line and not
+// reset them until a later one, the same SGRState should be used for all the
+// lines of text in a single Env.
+//
+// Other escape sequences and control characters are stripped out, so they
+// can't mess up the display or the line wrapping. Tabs are expanded to
+// spaces (see TabWidth).
+//
+// If Markup is true, the server's inline markup tags ("{b}bold{/b}") are
+// also interpreted; see (*SGRState) Tag(). Open tags are kept on a stack
+// so they can be nested.
+//
+type SGRState struct {
+  BaseFg, BaseBg termbox.Attribute
+  Fg, Bg         termbox.Attribute
+  Markup         bool
+  tags           []MarkupTag
+}
+
+// A MarkupTag remembers an open markup tag, and the colors in effect before
+// it was opened (which are restored when it is closed).
+//
+type MarkupTag struct {
+  Name   string
+  Fg, Bg termbox.Attribute
+}
+
+// Markup tags longer than this aren't considered tags.
+var MaxTagLen = 32
+
+// User-defined names for colors, usable in "{c:name}" tags, set with COLOR
+// rules. (See AddColorAlias().)
+var ColorAliases = make(map[string]string)
+
+func NewSGRState(fg, bg termbox.Attribute) *SGRState {
+  return &SGRState{ BaseFg: fg, BaseBg: bg, Fg: fg, Bg: bg }
+}
+
+// Returns a new *SGRState that also interprets markup tags.
+//
+func NewMarkupState(fg, bg termbox.Attribute) *SGRState {
+  s := NewSGRState(fg, bg)
+  s.Markup = true
+  return s
+}
+
+// (*SGRState) Tag() applies a markup tag (the text between the braces) and
+// returns true, or returns false if it isn't a tag it understands (in which
+// case it should just be displayed as text). Tags are:
+//
+//   {b} {i} {u}     bold, italic, underline
+//   {c:color}       color, either a COLOR alias or anything ParseColor()
+//                   understands
+//   {item}          the color for items (ItemFg)
+//   {player}        the color for players (PlayerFg)
+//   {/name}         closes the most recent open tag called name
+//   {/}             closes the most recent open tag
+//
+// A literal '{' is written "{{".
+//
+func (s *SGRState) Tag(tag string) bool {
+  tag = strings.ToLower(strings.TrimSpace(tag))
+  
+  if strings.HasPrefix(tag, "/") {
+    name := tag[1:]
+    for n := len(s.tags) - 1; n >= 0; n-- {
+      if name == "" || s.tags[n].Name == name {
+        s.Fg, s.Bg = s.tags[n].Fg, s.tags[n].Bg
+        s.tags = s.tags[:n]
+        return true
+      }
+    }
+    // Closing a known tag that isn't open is harmless; just drop it.
+    switch name {
+    case "", "b", "i", "u", "c", "item", "player":
+      return true
+    }
+    return false
   }
   
+  name, arg := tag, ""
+  if colon := strings.Index(tag, ":"); colon >= 0 {
+    name, arg = tag[:colon], strings.TrimSpace(tag[colon+1:])
+  }
+  fg := s.Fg
+  switch name {
+  case "b":
+    fg = fg | termbox.AttrBold
+  case "i":
+    fg = fg | termbox.AttrCursive
+  case "u":
+    fg = fg | termbox.AttrUnderline
+  case "c":
+    c, err := MarkupColor(arg)
+    if err != nil {
+      return false
+    }
+    fg = (fg & AttrMask) | c
+  case "item":
+    fg = (fg & AttrMask) | ItemFg
+  case "player":
+    fg = (fg & AttrMask) | PlayerFg
+  default:
+    return false
+  }
+  
+  s.tags = append(s.tags, MarkupTag{ Name: name, Fg: s.Fg, Bg: s.Bg })
+  s.Fg = fg
+  return true
+}
+
+// Returns the color named in a "{c:...}" tag.
+//
+func MarkupColor(name string) (termbox.Attribute, error) {
+  if desc, ok := ColorAliases[name]; ok {
+    return ParseColor(desc)
+  }
+  return ParseColor(name)
+}
+
+// Returns a new *Line with the given text, with colors starting from (and
+// updated by) the SGRState.
+//
+func (s *SGRState) NewLine(text string) *Line {
+  cellz := s.Append(make([]Cell, 0, len(text)), text)
   return &Line{ C: cellz, Width: -1, Starts: nil, Ends: nil, }
 }
 
-// Appends the given text with the supplied attributes to the receiving *Line.
+// (*SGRState) Append() appends Cells for the given text to cellz and returns
+// the result, interpreting SGR sequences and dropping everything else that
+// isn't printable.
 //
-func (l *Line) Add(text string, fg, bg termbox.Attribute) {
-  for _, ch := range text {
-    l.C = append(l.C, Cell{ Ch: ch, Fg: fg, Bg: bg, })
+func (s *SGRState) Append(cellz []Cell, text string) []Cell {
+  var i int = 0
+  for i < len(text) {
+    r, size := utf8.DecodeRuneInString(text[i:])
+    i = i + size
+    
+    if r == '\x1b' {
+      if i >= len(text) {
+        break
+      }
+      switch text[i] {
+      case '[':
+        // Control Sequence: parameter bytes, intermediate bytes, final byte.
+        j := i + 1
+        for j < len(text) && text[j] >= 0x30 && text[j] <= 0x3f {
+          j++
+        }
+        params := text[i+1:j]
+        for j < len(text) && text[j] >= 0x20 && text[j] <= 0x2f {
+          j++
+        }
+        if j < len(text) {
+          if text[j] == 'm' {
+            s.Apply(params)
+          }
+          j++
+        }
+        i = j
+      case ']', 'P', 'X', '^', '_':
+        // String sequences (like OSC), terminated by BEL or ESC \.
+        j := i + 1
+        for j < len(text) {
+          if text[j] == 7 {
+            j++
+            break
+          } else if text[j] == 0x1b && j+1 < len(text) && text[j+1] == '\\' {
+            j = j + 2
+            break
+          }
+          j++
+        }
+        i = j
+      default:
+        // Some other two-character escape.
+        _, size = utf8.DecodeRuneInString(text[i:])
+        i = i + size
+      }
+      continue
+    }
+    
+    if r == '{' && s.Markup {
+      if i < len(text) && text[i] == '{' {
+        i++
+      } else if close := strings.IndexByte(text[i:], '}');
+                close >= 0 && close <= MaxTagLen && s.Tag(text[i:i+close]) {
+        i = i + close + 1
+        continue
+      }
+    }
+    
+    if r == '\t' {
+      // Expand tabs to spaces out to the next tab stop.
+      n := 1
+      if TabWidth > 0 {
+        n = TabWidth - CellCols(cellz) % TabWidth
+      }
+      for ; n > 0; n-- {
+        cellz = append(cellz, Cell{ Ch: ' ', Fg: s.Fg, Bg: s.Bg, })
+      }
+      continue
+    }
+    if r < 32 || (r >= 0x7f && r < 0xa0) {
+      continue
+    }
+    if runewidth.RuneWidth(r) == 0 {
+      // A zero-width (usually combining) character attaches to the
+      // previous Cell. A Cell can only hold one rune, so it has to compose
+      // with it into a single character; if it doesn't, it's dropped.
+      if len(cellz) > 0 {
+        prev := &cellz[len(cellz)-1]
+        composed := []rune(norm.NFC.String(string([]rune{ prev.Ch, r })))
+        if len(composed) == 1 {
+          prev.Ch = composed[0]
+        }
+      }
+      continue
+    }
+    cellz = append(cellz, Cell{ Ch: r, Fg: s.Fg, Bg: s.Bg, })
+  }
+  return cellz
+}
+
+// (*SGRState) Apply() updates the current colors and attributes according
+// to the parameters of an SGR sequence ("1;31", for example). Supports the
+// standard 16 colors, 256-color ("38;5;n") and 24-bit ("38;2;r;g;b") colors
+// (approximated as necessary), and bold, underline, and reverse.
+//
+func (s *SGRState) Apply(params string) {
+  var codes []int
+  for _, p := range strings.FieldsFunc(params, func(r rune) bool {
+                       return r == ';' || r == ':' }) {
+    n, err := strconv.Atoi(p)
+    if err != nil {
+      return
+    }
+    codes = append(codes, n)
+  }
+  if len(codes) == 0 {
+    codes = []int{ 0 }
+  }
+  
+  set_fg := func(c termbox.Attribute) { s.Fg = (s.Fg & AttrMask) | c }
+  set_bg := func(c termbox.Attribute) { s.Bg = (s.Bg & AttrMask) | c }
+  
+  for n := 0; n < len(codes); n++ {
+    c := codes[n]
+    switch {
+    case c == 0:
+      s.Fg, s.Bg = s.BaseFg, s.BaseBg
+    case c == 1:
+      s.Fg = s.Fg | termbox.AttrBold
+    case c == 4:
+      s.Fg = s.Fg | termbox.AttrUnderline
+    case c == 7:
+      s.Fg = s.Fg | termbox.AttrReverse
+    case c == 22:
+      s.Fg = s.Fg &^ termbox.AttrBold
+    case c == 24:
+      s.Fg = s.Fg &^ termbox.AttrUnderline
+    case c == 27:
+      s.Fg = s.Fg &^ termbox.AttrReverse
+    case c >= 30 && c <= 37:
+      set_fg(termbox.ColorBlack + termbox.Attribute(c - 30))
+    case c >= 90 && c <= 97:
+      set_fg(termbox.ColorDarkGray + termbox.Attribute(c - 90))
+    case c == 39:
+      set_fg(s.BaseFg &^ AttrMask)
+    case c >= 40 && c <= 47:
+      set_bg(termbox.ColorBlack + termbox.Attribute(c - 40))
+    case c >= 100 && c <= 107:
+      set_bg(termbox.ColorDarkGray + termbox.Attribute(c - 100))
+    case c == 49:
+      set_bg(s.BaseBg &^ AttrMask)
+    case c == 38 || c == 48:
+      var color termbox.Attribute
+      if n+2 < len(codes) && codes[n+1] == 5 {
+        color = PaletteAttr(codes[n+2])
+        n = n + 2
+      } else if n+4 < len(codes) && codes[n+1] == 2 {
+        color = RGBAttr(codes[n+2], codes[n+3], codes[n+4])
+        n = n + 4
+      } else {
+        return
+      }
+      if c == 38 {
+        set_fg(color)
+      } else {
+        set_bg(color)
+      }
+    }
+  }
+}
+
+// Returns a copy of the given text with any ANSI escape sequences and
+// control characters removed.
+//
+func StripANSI(text string) string {
+  return NewLine(text, 0, 0).String()
+}
+
+// Returns, for each byte offset into text (a Line's String()) where a rune
+// starts, the index of that rune's Cell. The offset len(text) maps to the
+// number of Cells. Used to turn regexp matches into Cell ranges.
+//
+func cellIndex(text string) []int {
+  cell_idx := make([]int, len(text)+1)
+  var ci int = 0
+  for bi := range text {
+    cell_idx[bi] = ci
+    ci++
+  }
+  cell_idx[len(text)] = ci
+  return cell_idx
+}
+
+// (*Line) Substitute() replaces every match of re in the Line's text with
+// repl, which may refer to capture groups as in regexp.Expand() ("$1",
+// "${name}"). Cells outside the matches keep their attributes; replacement
+// text takes on the attributes of the first Cell of the text it replaces.
+// Returns whether anything was replaced.
+//
+func (l *Line) Substitute(re *regexp.Regexp, repl string) bool {
+  text := l.String()
+  matches := re.FindAllStringSubmatchIndex(text, -1)
+  if matches == nil {
+    return false
+  }
+  
+  // The regexp deals in byte offsets into text; we need Cell offsets.
+  cell_idx := cellIndex(text)
+  
+  new_c := make([]Cell, 0, len(l.C))
+  var last int = 0
+  for _, m := range matches {
+    start, end := cell_idx[m[0]], cell_idx[m[1]]
+    new_c = append(new_c, l.C[last:start]...)
+    fg, bg := DefaultFg, DefaultBg
+    if start < len(l.C) {
+      fg, bg = l.C[start].Fg, l.C[start].Bg
+    } else if start > 0 {
+      fg, bg = l.C[start-1].Fg, l.C[start-1].Bg
+    }
+    for _, ch := range string(re.ExpandString(nil, repl, text, m)) {
+      new_c = append(new_c, Cell{ Ch: ch, Fg: fg, Bg: bg, })
+    }
+    last = end
   }
+  new_c = append(new_c, l.C[last:]...)
+  
+  l.C = new_c
   l.Width = -1
   l.Starts = nil
   l.Ends = nil
+  return true
+}
+
+// (*Line) FindAll() returns the start and end Cell indices of every
+// (non-empty) match of re in the Line's text.
+//
+func (l *Line) FindAll(re *regexp.Regexp) [][2]int {
+  text := l.String()
+  matches := re.FindAllStringIndex(text, -1)
+  if matches == nil {
+    return nil
+  }
+  
+  cell_idx := cellIndex(text)
+  
+  spans := make([][2]int, 0, len(matches))
+  for _, m := range matches {
+    if m[1] > m[0] {
+      spans = append(spans, [2]int{ cell_idx[m[0]], cell_idx[m[1]] })
+    }
+  }
+  return spans
 }
 
-// All currently-remembered Lines of game window history.
+// The Lines of game window history currently held in memory. (Lines[0] is
+// the Line with global index LineBase; see GetLine().)
 var Lines []*Line = make([]*Line, 0, 0)
 // Dimensions of the terminal window. Set with Recalculate() (below).
 var TermW, TermH int
 // Vertical offsets of the Header line, the game window, the Footer line,
 // and the command input line.
 var HeadY, SbackY, FootY, InputY int
+// Width of the game window (which is less than TermW if the chat pane is
+// beside it).
+var SbackW int
+// Width of the game text, and the column where it starts. (See MaxTextWidth.)
+var TextW, TextX int
+// Width of the timestamp gutter to the left of TextX (0 if timestamps
+// aren't being shown).
+var GutterW int
+// The number of columns preformatted Lines in the game window have been
+// scrolled to the left, and how many columns each horizontal scroll moves.
+var HScroll int = 0
+var HScrollStep = 8
 // If the insertion point in the command entry line gets this far to the
 // right, the view of the command entry line will scroll to prevent it from
 // moving any farther.
 var InputRL int
+// Shown at the beginning of the command input line, before the Input (when
+// the line is being used to prompt for something other than a command).
+var InputPrompt = ""
 // Default terminal colors.
 var DefaultFg, DefaultBg = termbox.ColorDefault, termbox.ColorBlack
+// Colors of the command input line.
+var InputFg, InputBg = termbox.ColorDefault, termbox.ColorBlack
 // Contents of the lines directly above and below the game window. As of
 // 2017-08-27, the HeadLine shows the character's current Room name, and
 // the FootLine shows debugging information (when DEBUG == true).
@@ -273,9 +912,19 @@ var HeadLine, FootLine *Line
 var Input = make([]rune, 0, 0)
 // Offset of the insertion point in the Input slice.
 var IP int = 0
-// The number of rows of text the game window has been scrolled back. (This is
-// not Lines, but physical rows of characters.)
-var ScrollbackPos int = 0
+// Where the game window history is scrolled to. When ViewLine is -1 (which
+// it usually is), the newest text is at the bottom of the game window.
+// Otherwise the game window has been scrolled back, and row ViewRow of the
+// Line with global index ViewLine (see GetLine()) is at the bottom of the
+// game window.
+//
+// Keeping track of the position this way (rather than as a number of rows
+// scrolled back from the newest text) means that drawing the game window
+// only ever has to deal with (and wrap) the Lines that are actually visible,
+// no matter how much history there is or how far back it's scrolled, and
+// the view stays put when new text arrives.
+var ViewLine int = -1
+var ViewRow  int = 0
 // Slice storing remembered commands.
 var cmdHist = make([]string, 0, 0)
 // Which remembered command in the command history is currently being shown.
@@ -302,20 +951,46 @@ var CanScrollBack = false
 // get stashed here.
 var LogoutMessages = make([]string, 0, 0)
 
-// Adds a line of text to the game window. If the number of remembered lines
-// exceeds MaxScrollbackLines, the oldest get trimmed down so only
-// MinScrollbackLines are remembered.
+// Adds a line of text to the game window, stamped with the current time
+// (unless it already has been), and logs it if it didn't come from the game
+// (AddEnvLine() logs those, whether or not they end up here). If the number
+// of remembered lines exceeds MaxScrollbackLines, the oldest get trimmed
+// down so only MinScrollbackLines are kept in memory; the trimmed ones are
+// written to the ScrollStore (see SpillLines()).
 //
 func AddLine(newLine *Line) {
   log.Println("AddLine(", newLine.String(), "):")
+  if newLine.Time.IsZero() {
+    newLine.Time = time.Now()
+  }
+  if newLine.Type == "" {
+    LogLine(newLine)
+  }
   if len(Lines) >= MaxScrollbackLines {
     log.Println("    reallocating buffer")
+    dropped := len(Lines) - MinScrollbackLines
+    SpillLines(Lines[:dropped])
     new_lines := make([]*Line, 0, MaxScrollbackLines)
-    new_lines = append(new_lines, Lines[len(Lines)-MinScrollbackLines:]...)
+    new_lines = append(new_lines, Lines[dropped:]...)
     Lines = new_lines
+    LineBase = LineBase + dropped
+    if ViewLine >= 0 && ViewLine < FirstLine() {
+      ViewLine, ViewRow = FirstLine(), 0
+    }
+    for len(ViewIndex) > 0 && ViewIndex[0] < FirstLine() {
+      ViewIndex = ViewIndex[1:]
+    }
   }
   Lines = append(Lines, newLine)
+  if ViewTypes != nil && Shown(newLine) {
+    ViewIndex = append(ViewIndex, NumLines() - 1)
+  }
   log.Println("    buffer lines:", len(Lines))
+  if SearchRe != nil {
+    PruneSearchHits()
+    SearchLine(NumLines() - 1, newLine)
+    UpdateFootLine()
+  }
 }
 
 // Adds a line of text with the default attributes.
@@ -324,474 +999,3421 @@ func AddDefaultLine(text string) {
   AddLine(NewLine(text, DefaultFg, DefaultBg))
 }
 
-// Sets the remembered terminal dimensions to the actual terminal dimensions.
-// Called at initialization and every time the terminal window is resized.
-//
-func Redimension(x, y int) {
-  TermW, TermH = x, y
-  log.Println("Redimension()ing: (", TermW, TermH, ")")
-}
+// Global index of the first Line from the game added while the game window
+// was scrolled back (-1 if it isn't, or nothing has arrived since it was),
+// the number of such Lines, and the index of the Line with the unread-text
+// Marker (-1 if none has one). Set by AddEnvLine(); the client's own
+// messages don't count.
+var UnreadFrom  int = -1
+var UnreadLines int = 0
+var MarkerIdx   int = -1
 
-// Recalculates some important values. Called every time Redimension() is.
+// Returns the number of Lines from the game that have arrived since the game
+// window was scrolled back.
 //
-func Recalculate() {
-  HeadY  = 0
-  SbackY = 1
-  FootY  = TermH - 2
-  InputY = TermH -1
-  InputRL = (2 * TermW) / 3
-  log.Println("Recalculate()ing: HeadY, SbackY, FootY, InputY:",
-              HeadY, SbackY, FootY, InputY)
+func UnreadCount() int {
+  if UnreadFrom < 0 {
+    return 0
+  }
+  return UnreadLines
 }
 
-// Draws the Head Line (above the game window). Called when its text changes.
+// Once the game window is back to following the newest text, move the
+// unread-text Marker to the first Line that arrived while it wasn't.
 //
-func DrawHeadLine() {
-  var fence int
-  
-  if len(HeadLine.C) <= TermW {
-    fence = len(HeadLine.C)
-  } else {
-    fence = TermW
+func PlaceMarker() {
+  if UnreadFrom < 0 || ScrolledBack() {
+    return
   }
-  
-  for n := 0; n < fence; n++ {
-    ch := HeadLine.C[n]
-    termbox.SetCell(n, HeadY, ch.Ch, ch.Fg, ch.Bg)
+  if MarkerIdx >= LineBase {
+    GetLine(MarkerIdx).Marker = false
   }
-  for n := fence; n < TermW; n++ {
-    termbox.SetCell(n, HeadY, ' ', HeadTailFg, HeadTailBg)
+  MarkerIdx, UnreadFrom, UnreadLines = UnreadFrom, -1, 0
+  if MarkerIdx >= LineBase {
+    GetLine(MarkerIdx).Marker = true
   }
 }
 
-// Draw the Foot line (below the game window). Called when its text changes.
+// Scroll the game window so the unread-text marker (or, while still
+// scrolled back, the first unread Line) is at the top.
 //
-func DrawFootline() {
-  var fence int
-  
-  if len(FootLine.C) <= TermW {
-    fence = len(FootLine.C)
-  } else {
-    fence = TermW
-  }
-  
-  for n := 0; n < fence; n++ {
-    ch := FootLine.C[n]
-    termbox.SetCell(n, FootY, ch.Ch, ch.Fg, ch.Bg)
+func JumpToMarker() {
+  target := MarkerIdx
+  if UnreadFrom >= 0 {
+    target = UnreadFrom
   }
-  for n := fence; n < TermW; n++ {
-    termbox.SetCell(n, FootY, ' ', HeadTailFg, HeadTailBg)
+  if target < FirstLine() || target >= NumLines() {
+    return
   }
+  ScrollTo(RowsForward(target, 0, HistoryRows() - 1))
+  DrawScrollback()
 }
 
-// Draw the current command input line. Called when its contents changes.
+// Number of speech Lines that have arrived while the game window was
+// scrolled back; shown at the front of the terminal's title.
+var UnreadSpeech int = 0
+// The title most recently given to the terminal, and whether the terminal
+// has been asked to save its original one (so Finalize() can restore it).
+var LastTitle  = ""
+var TitleSaved = false
+
+// Returns what the terminal's title should be: TitleFormat with {char} and
+// {room} filled in, preceded by UnreadSpeech (if there is any). Separators
+// left dangling at the end by an empty {room} are trimmed.
 //
-func DrawInput() {
-  var n int = 0
-  var scroll int = 0
-  
-  if IP > InputRL {
-    scroll = IP - InputRL
-  }
-  if scroll < 0 {
-    scroll = 0
-  }
-  
-  ip_pos := IP - scroll
-  input_end := len(Input) - scroll
-  
-  for n := 0; n < ip_pos; n++ {
-    termbox.SetCell(n, InputY, Input[n+scroll], DefaultFg, DefaultBg)
+func Title() string {
+  room := strings.TrimSpace(HeadLine.String())
+  title := strings.NewReplacer("{char}", CharName, "{room}", room).Replace(TitleFormat)
+  title = strings.TrimRight(title, " -–—:|")
+  if UnreadSpeech > 0 {
+    title = fmt.Sprintf("(%d) %s", UnreadSpeech, title)
   }
-  if IP == len(Input) {
-    termbox.SetCell(ip_pos, InputY, ' ', DefaultFg | termbox.AttrReverse,
-                                         DefaultBg | termbox.AttrReverse)
-    for n = ip_pos+1; n < TermW; n++ {
-      termbox.SetCell(n, InputY, ' ', DefaultFg, DefaultBg)
-    }
-  } else {
-    termbox.SetCell(ip_pos, InputY, Input[IP], DefaultFg | termbox.AttrReverse, 
-                                               DefaultBg | termbox.AttrReverse)
-    for n = ip_pos+1; n < input_end; n++ {
-      termbox.SetCell(n, InputY, Input[n+scroll], DefaultFg, DefaultBg)
+  return strings.Map(func(r rune) rune {
+    if r < ' ' || r == 0x7f {
+      return -1
     }
-    for n = input_end; n < TermW; n++ {
-      termbox.SetCell(n, InputY, ' ', DefaultFg, DefaultBg)
-    }
-  }
-  
-  if scroll > 0 {
-    termbox.SetCell(0, InputY, '<', DefaultFg | termbox.AttrReverse,
-                                    DefaultBg | termbox.AttrReverse)
+    return r
+  }, title)
+}
+
+// Set the terminal's title (with an OSC 2 escape sequence) if it has
+// changed. Does nothing if TitleFormat is blank.
+//
+func UpdateTitle() {
+  if TitleFormat == "" {
+    return
   }
-  if len(Input) > scroll + TermW {
-    termbox.SetCell(TermW - 1, InputY, '>', DefaultFg | termbox.AttrReverse,
-                                            DefaultBg | termbox.AttrReverse)
+  title := Title()
+  if title == LastTitle {
+    return
   }
-  
-  
+  LastTitle = title
+  fmt.Fprintf(os.Stdout, "\x1b]2;%s\x07", title)
 }
 
-// Helper function used by DrawScrollback(). After a Line of text has been
-// Wrap()ped, it draws the chunkth row of characters from that line on the
-// yth row of the terminal window.
+// Ask the terminal to save its current title (on its title stack; this
+// isn't supported everywhere, but the title can't be reliably read back
+// otherwise), then set ours.
 //
-func DrawLineChunk(l *Line, chunk int, y int) {
-  log.Println("(*Line) DrawLineChunk(): [", l.Starts[chunk], l.Ends[chunk],
-              "], pos:", y, "(", l.String(), ")")
-  var term_x int = 0
-  var end_x  int = l.Ends[chunk]
-  var ch Cell
-  for n := l.Starts[chunk]; n < end_x; n++ {
-    ch = l.C[n]
-    termbox.SetCell(term_x, y, ch.Ch, ch.Fg, ch.Bg)
-    term_x++
-  }
-  for ; term_x < TermW; term_x++ {
-    termbox.SetCell(term_x, y, ' ', DefaultFg, DefaultBg)
+func StartTitle() {
+  if TitleFormat == "" {
+    return
   }
+  fmt.Fprint(os.Stdout, "\x1b[22;0t")
+  TitleSaved = true
+  UpdateTitle()
 }
 
-// Scroll the game window history one screen backward (if possible).
+// Put back the title the terminal had before StartTitle().
 //
-func ScrollBackward() {
-  if CanScrollBack {
-    delta := (FootY - SbackY) - ScrollbackOverlap
-    ScrollbackPos = ScrollbackPos + delta
-    DrawScrollback()
+func RestoreTitle() {
+  if TitleSaved {
+    fmt.Fprint(os.Stdout, "\x1b[23;0t")
+    TitleSaved = false
   }
 }
 
-// Scroll the game window history one screen forward (if possible).
+// Global index (counting from the first Line of the session) of Lines[0].
+// Older Lines have been trimmed from memory and, if StoreScrollback is set,
+// written to the ScrollStore.
+var LineBase int = 0
+// Where trimmed Lines are written. This is nil until the first time Lines
+// get trimmed (or if StoreScrollback is false, or the store couldn't be
+// written).
+var ScrollStore *LineStore
+// The number of Lines read back from the ScrollStore to keep around (so
+// they don't have to be read and rewrapped every time the game window is
+// redrawn).
+const StoreCacheSize = 256
+
+// Returns the number of Lines in the whole game window history, including
+// any that have been trimmed from memory.
 //
-func ScrollForward() {
-  if ScrollbackPos > 0 {
-    delta := (FootY - SbackY) - ScrollbackOverlap
-    ScrollbackPos = ScrollbackPos - delta
-    if ScrollbackPos < 0 {
-      ScrollbackPos = 0
-    }
-    DrawScrollback()
-  }
+func NumLines() int {
+  return LineBase + len(Lines)
 }
 
-// Jump the game window history to the most recent messaging.
+// Returns the global index of the oldest Line still available: 0 if the
+// trimmed Lines are in the ScrollStore, LineBase if they were discarded.
 //
-func ScrollToFront() {
-  if ScrollbackPos > 0 {
-    ScrollbackPos = 0
-    DrawScrollback()
+func FirstLine() int {
+  if ScrollStore != nil {
+    return 0
   }
+  return LineBase
 }
 
-// Draw the game window.
+// Returns the Line with the given global index (which must be between
+// FirstLine() and NumLines() - 1).
 //
-// This is the most complex of all the drawing operations. Overview:
-// 
-// Starting with the most recent Line:
-//   * Wrap() it if it is not already wrapped to the current terminal width.
-//   * Write those rows to the terminal, starting from the bottom-most row
-//     and working upward.
-// Repeat with the next-most recent Line, continuing until either the top of
-// the game window has been reached, or the text of all the lines has been
-// written.
+func GetLine(idx int) *Line {
+  if idx >= LineBase {
+    return Lines[idx - LineBase]
+  }
+  return ScrollStore.Get(idx)
+}
+
+// Returns the directory where the client keeps files it writes:
+// $XDG_DATA_HOME/dta5, or ~/.local/share/dta5 if XDG_DATA_HOME isn't set.
 //
-// If the most recent history isn't being viewed (that is, if
-// ScrollbackPos > 0), then wrap lines and count rows of text but don't start
-// writing to the bottom of the game window until the ScrollbackPosth row of
-// text is reached.
+func DataDir() (string, error) {
+  if d := os.Getenv("XDG_DATA_HOME"); d != "" {
+    return filepath.Join(d, "dta5"), nil
+  }
+  home, err := os.UserHomeDir()
+  if err != nil {
+    return "", err
+  }
+  return filepath.Join(home, ".local", "share", "dta5"), nil
+}
+
+// Write Lines being trimmed from memory to the ScrollStore (opening it
+// first, if need be). If anything goes wrong, the store is abandoned and
+// trimmed Lines are just discarded from then on.
 //
-func DrawScrollback() {
-  log.Println("DrawScrollback() called...")
-  write_start := FootY - 1
-  yp := write_start + ScrollbackPos
-  lidx := len(Lines) - 1
-  var cur_line *Line
-  CanScrollBack = true
-  
-  for (yp >= SbackY) && (lidx >= 0) {
-    if lidx == 0 {
-      CanScrollBack = false
+func SpillLines(lines []*Line) {
+  if !StoreScrollback {
+    return
+  }
+  var err error
+  if ScrollStore == nil {
+    dir := ScrollbackDir
+    if dir == "" {
+      if dir, err = DataDir(); err == nil {
+        dir = filepath.Join(dir, "scrollback")
+      }
     }
-    
-    log.Println("yp, lidx:", yp, lidx)
-    
-    cur_line = Lines[lidx]
-    if cur_line.Width != TermW {
-      cur_line.Wrap(TermW)
+    if err == nil {
+      ScrollStore, err = OpenLineStore(dir)
     }
-    
-    for n := cur_line.Len()-1; (n >= 0) && (yp >= SbackY); n-- {
-      if yp <= write_start {
-        DrawLineChunk(cur_line, n, yp)
+  }
+  for n := 0; err == nil && n < len(lines); n++ {
+    err = ScrollStore.Append(lines[n])
+  }
+  if err != nil {
+    log.Println("SpillLines(): giving up on scrollback store:", err)
+    if ScrollStore != nil {
+      ScrollStore.Close(false)
+      ScrollStore = nil
+    }
+    StoreScrollback = false
+  }
+}
+
+// A LineStore is an append-only file of Lines trimmed from the game window
+// history, one record (see EncodeLine()) per Line. Offsets holds where each
+// record starts, so any Line can be read back with a single ReadAt(), and
+// Types holds each Line's Type, so views (see ViewIndex) can be built
+// without reading any back.
+//
+// Trimmed Lines are in the current theme's colors when they're written;
+// Epochs remembers which colors those were, so Lines read back after a
+// theme change can be recolored to match.
+//
+type LineStore struct {
+  F       *os.File
+  W       *bufio.Writer
+  Offsets []int64
+  Types   []string
+  Size    int64
+  Epochs  []StoreEpoch
+  cache   map[int]*Line
+}
+
+// The ColorPairs in effect when the Lines from Start on were written.
+//
+type StoreEpoch struct {
+  Start int
+  Pairs [][2]termbox.Attribute
+}
+
+// Create a new, empty LineStore in a file (named for the current time)
+// in the given directory, creating the directory if necessary.
+//
+func OpenLineStore(dir string) (*LineStore, error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+  pattern := time.Now().Format("2006-01-02_15-04-05") + "_*.scrollback"
+  f, err := os.CreateTemp(dir, pattern)
+  if err != nil {
+    return nil, err
+  }
+  log.Println("OpenLineStore(): storing scrollback in", f.Name())
+  s := &LineStore{
+    F:       f,
+    W:       bufio.NewWriter(f),
+    Offsets: make([]int64, 0, 0),
+    Types:   make([]string, 0, 0),
+    Epochs:  []StoreEpoch{ StoreEpoch{ 0, CurrentColorPairs() } },
+    cache:   make(map[int]*Line),
+  }
+  return s, nil
+}
+
+// (*LineStore) Len() returns the number of Lines in the store.
+//
+func (s *LineStore) Len() int {
+  return len(s.Offsets)
+}
+
+// (*LineStore) Append() writes a Line to the end of the store.
+//
+func (s *LineStore) Append(l *Line) error {
+  rec := EncodeLine(make([]byte, 0, 2 * len(l.C) + 8), l)
+  var hdr [binary.MaxVarintLen64]byte
+  hn := binary.PutUvarint(hdr[:], uint64(len(rec)))
+  if _, err := s.W.Write(hdr[:hn]); err != nil {
+    return err
+  }
+  if _, err := s.W.Write(rec); err != nil {
+    return err
+  }
+  s.Offsets = append(s.Offsets, s.Size)
+  s.Types = append(s.Types, l.Type)
+  s.Size = s.Size + int64(hn + len(rec))
+  return nil
+}
+
+// (*LineStore) Get() returns the nth Line in the store. If it can't be read,
+// a Line saying so is returned instead.
+//
+func (s *LineStore) Get(n int) *Line {
+  if l, ok := s.cache[n]; ok {
+    return l
+  }
+  if len(s.cache) >= StoreCacheSize {
+    s.cache = make(map[int]*Line)
+  }
+  l, err := s.read(n)
+  if err != nil {
+    log.Printf("(*LineStore) Get(%d): %s", n, err)
+    l = NewLine("[ unreadable scrollback ]", SysFg, SysBg)
+  } else {
+    e := len(s.Epochs) - 1
+    for s.Epochs[e].Start > n {
+      e--
+    }
+    l.Recolor(s.Epochs[e].Pairs, CurrentColorPairs())
+  }
+  s.cache[n] = l
+  return l
+}
+
+func (s *LineStore) read(n int) (*Line, error) {
+  if s.W.Buffered() > 0 {
+    if err := s.W.Flush(); err != nil {
+      return nil, err
+    }
+  }
+  end := s.Size
+  if n + 1 < len(s.Offsets) {
+    end = s.Offsets[n + 1]
+  }
+  buf := make([]byte, end - s.Offsets[n])
+  if _, err := s.F.ReadAt(buf, s.Offsets[n]); err != nil {
+    return nil, err
+  }
+  _, hn := binary.Uvarint(buf)
+  if hn <= 0 {
+    return nil, fmt.Errorf("bad record header")
+  }
+  return DecodeLine(buf[hn:])
+}
+
+// (*LineStore) Recolored() should be called after the colors change, so
+// Lines read back from then on get recolored properly.
+//
+func (s *LineStore) Recolored() {
+  s.Epochs = append(s.Epochs, StoreEpoch{ s.Len(), CurrentColorPairs() })
+  s.cache = make(map[int]*Line)
+}
+
+// (*LineStore) Close() closes the store's file, and deletes it unless
+// keep is true.
+//
+func (s *LineStore) Close(keep bool) {
+  if err := s.W.Flush(); err != nil {
+    log.Println("(*LineStore) Close():", err)
+  }
+  s.F.Close()
+  if !keep {
+    os.Remove(s.F.Name())
+  }
+}
+
+// Appends the record for the given Line to buf. A record is a flags byte
+// (1 if the Line is Pre), the Line's Time (as a varint count of nanoseconds
+// since the Unix epoch, or 0 if it has none), its Type (as a uvarint length
+// and the bytes), then one run for each stretch of Cells with the same
+// colors: the foreground and background (as uvarints), the length of the
+// text (ditto), and the text itself, in UTF-8.
+//
+func EncodeLine(buf []byte, l *Line) []byte {
+  var flags byte = 0
+  if l.Pre {
+    flags = flags | 1
+  }
+  buf = append(buf, flags)
+  var stamp int64 = 0
+  if !l.Time.IsZero() {
+    stamp = l.Time.UnixNano()
+  }
+  buf = binary.AppendVarint(buf, stamp)
+  buf = binary.AppendUvarint(buf, uint64(len(l.Type)))
+  buf = append(buf, l.Type...)
+  for start := 0; start < len(l.C); {
+    fg, bg := l.C[start].Fg, l.C[start].Bg
+    end, size := start, 0
+    for end < len(l.C) && l.C[end].Fg == fg && l.C[end].Bg == bg {
+      size = size + utf8.RuneLen(l.C[end].Ch)
+      end++
+    }
+    buf = binary.AppendUvarint(buf, uint64(fg))
+    buf = binary.AppendUvarint(buf, uint64(bg))
+    buf = binary.AppendUvarint(buf, uint64(size))
+    for _, c := range l.C[start:end] {
+      buf = utf8.AppendRune(buf, c.Ch)
+    }
+    start = end
+  }
+  return buf
+}
+
+// Returns the Line encoded in the given record (see EncodeLine()).
+//
+func DecodeLine(rec []byte) (*Line, error) {
+  if len(rec) < 1 {
+    return nil, fmt.Errorf("empty record")
+  }
+  l := &Line{ C: make([]Cell, 0, len(rec)), Width: -1, Pre: rec[0] & 1 != 0 }
+  rec = rec[1:]
+  stamp, sn := binary.Varint(rec)
+  if sn <= 0 {
+    return nil, fmt.Errorf("bad record")
+  }
+  if stamp != 0 {
+    l.Time = time.Unix(0, stamp)
+  }
+  rec = rec[sn:]
+  tlen, tn := binary.Uvarint(rec)
+  if tn <= 0 || tlen > uint64(len(rec) - tn) {
+    return nil, fmt.Errorf("bad record")
+  }
+  l.Type = string(rec[tn:tn + int(tlen)])
+  rec = rec[tn + int(tlen):]
+  for len(rec) > 0 {
+    var vals [3]uint64
+    for n := range vals {
+      v, vn := binary.Uvarint(rec)
+      if vn <= 0 {
+        return nil, fmt.Errorf("bad record")
       }
-      yp--
+      vals[n], rec = v, rec[vn:]
+    }
+    if vals[2] > uint64(len(rec)) {
+      return nil, fmt.Errorf("truncated record")
+    }
+    fg, bg := termbox.Attribute(vals[0]), termbox.Attribute(vals[1])
+    for _, r := range string(rec[:vals[2]]) {
+      l.C = append(l.C, Cell{ Ch: r, Fg: fg, Bg: bg })
     }
-    lidx--
+    rec = rec[vals[2]:]
   }
-  
-  for yp >= SbackY {
-    for n := 0; n < TermW; n++ {
-      termbox.SetCell(n, yp, ' ', DefaultFg, DefaultBg)
+  return l, nil
+}
+
+// Returns the parameters of an ANSI "Select Graphic Rendition" escape
+// sequence (the part between "\x1b[" and "m") that selects the given
+// foreground and background, starting from a reset.
+//
+func SGRParams(fg, bg termbox.Attribute) string {
+  params := []string{ "0" }
+  attrs := fg | bg
+  for _, a := range []struct{ attr termbox.Attribute; param string }{
+    { termbox.AttrBold, "1" },
+    { termbox.AttrDim, "2" },
+    { termbox.AttrCursive, "3" },
+    { termbox.AttrUnderline, "4" },
+    { termbox.AttrBlink, "5" },
+    { termbox.AttrReverse, "7" },
+    { termbox.AttrHidden, "8" },
+  } {
+    if attrs & a.attr != 0 {
+      params = append(params, a.param)
     }
-    yp--
   }
-  
-  if ScrollbackPos > 0 {
-    termbox.SetCell(TermW-1, FootY-1, 'v', DefaultFg | termbox.AttrReverse,
-                                           DefaultBg | termbox.AttrReverse)
+  // A color Attribute n is palette color n - 1 (0 is the default).
+  for n, c := range []termbox.Attribute{ fg &^ AttrMask, bg &^ AttrMask } {
+    base := 30 + 10 * n
+    switch {
+    case c == termbox.ColorDefault:
+    case c <= 8:
+      params = append(params, strconv.Itoa(base + int(c) - 1))
+    case c <= 16:
+      params = append(params, strconv.Itoa(base + 60 + int(c) - 9))
+    default:
+      params = append(params, fmt.Sprintf("%d;5;%d", base + 8, int(c) - 1))
+    }
   }
-  if CanScrollBack {
-    termbox.SetCell(TermW-1, SbackY, '^', DefaultFg | termbox.AttrReverse,
-                                          DefaultBg | termbox.AttrReverse)
+  return strings.Join(params, ";")
+}
+
+// (*Line) ANSI() returns the Line's text with ANSI escape sequences setting
+// its colors and attributes.
+//
+func (l *Line) ANSI() string {
+  var sb strings.Builder
+  var fg, bg termbox.Attribute = termbox.ColorDefault, termbox.ColorDefault
+  for _, c := range l.C {
+    if c.Fg != fg || c.Bg != bg {
+      fg, bg = c.Fg, c.Bg
+      sb.WriteString("\x1b[" + SGRParams(fg, bg) + "m")
+    }
+    sb.WriteRune(c.Ch)
   }
-  
-  log.Println("...DrawScrollback() finished")
+  if fg != termbox.ColorDefault || bg != termbox.ColorDefault {
+    sb.WriteString("\x1b[0m")
+  }
+  return sb.String()
 }
 
-// Insert a character into the current command and redraw the input line.
+// Session logging: all game text (including echoed commands, and speech that
+// only goes to the chat pane) and client messages can be written to a log
+// file. GameLogFile is a template for the file's name, in which "%c" is
+// replaced with the character's name, "%d" with the date (YYYY-MM-DD), and
+// "%%" with "%"; if it's empty, logs go in a "logs" directory under
+// DataDir(). GameLogFormat is "plain" or "ansi" (to keep colors). A new file
+// is started each day if GameLogDaily is set (and GameLogFile includes the
+// date), and whenever a file reaches GameLogMaxKB kilobytes (if that isn't
+// 0), with "-2", "-3", &c. added to the name. GameLogTimestamps puts each
+// Line's Time at the start of its log entry.
+var Logging           = false
+var GameLogFile       = ""
+var GameLogFormat     = "plain"
+var GameLogDaily      = true
+var GameLogMaxKB      = 0
+var GameLogTimestamps = true
+// The name the player logged in with.
+var CharName = ""
+
+// A GameLog is an open session log file.
 //
-func InsertInInput(r rune) {
-  if IP == len(Input) {
-    Input = append(Input, r)
-  } else {
-    new_input := make([]rune, 0, len(Input)+1)
-    new_input = append(new_input, Input[:IP]...)
-    new_input = append(new_input, r)
-    new_input = append(new_input, Input[IP:]...)
-    Input = new_input
+type GameLog struct {
+  F    *os.File
+  Day  string
+  Seq  int
+  Size int64
+}
+
+var SessionLog *GameLog
+
+// Returns the name of the log file for the given day and sequence number.
+//
+func GameLogName(day string, seq int) (string, error) {
+  tmpl := GameLogFile
+  if tmpl == "" {
+    dir, err := DataDir()
+    if err != nil {
+      return "", err
+    }
+    tmpl = filepath.Join(dir, "logs", "%c_%d.log")
   }
-  IP++
-  
-  DrawInput()
+  name := CharName
+  if name == "" {
+    name = "dta5"
+  }
+  var sb strings.Builder
+  for n := 0; n < len(tmpl); n++ {
+    if tmpl[n] != '%' || n + 1 == len(tmpl) {
+      sb.WriteByte(tmpl[n])
+      continue
+    }
+    n++
+    switch tmpl[n] {
+    case 'c':
+      sb.WriteString(name)
+    case 'd':
+      sb.WriteString(day)
+    default:
+      sb.WriteByte(tmpl[n])
+    }
+  }
+  fname := sb.String()
+  if seq > 1 {
+    ext := filepath.Ext(fname)
+    fname = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(fname, ext), seq, ext)
+  }
+  return fname, nil
 }
 
-// If possible, delete the character to the left of the insertion point in
-// the current command, then redraw the input line.
+// Open (appending to) the log file for the current day, skipping past any
+// that are already too big. Returns the file's name.
 //
-func InputBackspace() {
-  if IP > 0 {
-    Input = append(Input[:IP-1], Input[IP:]...)
-    IP--
-    DrawInput()
+func OpenGameLog() (string, error) {
+  day := time.Now().Format("2006-01-02")
+  for seq := 1; ; seq++ {
+    fname, err := GameLogName(day, seq)
+    if err != nil {
+      return "", err
+    }
+    if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+      return "", err
+    }
+    f, err := os.OpenFile(fname, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600)
+    if err != nil {
+      return "", err
+    }
+    fi, err := f.Stat()
+    if err != nil {
+      f.Close()
+      return "", err
+    }
+    if GameLogMaxKB > 0 && fi.Size() >= int64(GameLogMaxKB) * 1024 {
+      f.Close()
+      continue
+    }
+    CloseGameLog()
+    SessionLog = &GameLog{ F: f, Day: day, Seq: seq, Size: fi.Size() }
+    log.Println("OpenGameLog(): logging to", fname)
+    return fname, nil
   }
 }
 
-// If possible, delete the character at the insertion point in the current
-// command, then redraw the input line.
+// Close the log file, if one is open.
 //
-func InputDelete() {
-  if IP < len(Input) {
-    Input = append(Input[:IP], Input[IP+1:]...)
-    DrawInput()
+func CloseGameLog() {
+  if SessionLog != nil {
+    SessionLog.F.Close()
+    SessionLog = nil
   }
 }
 
-// Move the insertion point in the current command right delta characters
-// (negative values of delta will move the IP left). Bound movement so that
-// the IP doesn't go beyond the beginning or end of the current command.
-// Redraw the input line.
+// Write a Line to the log file (if logging), starting a new file first if
+// it's time to.
 //
-func MoveInputIp(delta int) {
-  new_ip := IP + delta
-  if new_ip < 0 {
-    IP = 0
-  } else if new_ip > len(Input) {
-    IP = len(Input)
+func LogLine(l *Line) {
+  if SessionLog == nil {
+    return
+  }
+  if GameLogDaily && time.Now().Format("2006-01-02") != SessionLog.Day {
+    OpenGameLog()
+  } else if GameLogMaxKB > 0 && SessionLog.Size >= int64(GameLogMaxKB) * 1024 {
+    OpenGameLog()
+  }
+  if SessionLog == nil {
+    return
+  }
+  var text string
+  if GameLogFormat == "ansi" {
+    text = l.ANSI()
   } else {
-    IP = new_ip
+    text = l.String()
+  }
+  if GameLogTimestamps && !l.Time.IsZero() {
+    text = "[" + l.Time.Format(TimestampFormat) + "] " + text
+  }
+  n, err := SessionLog.F.WriteString(text + "\n")
+  SessionLog.Size = SessionLog.Size + int64(n)
+  if err != nil {
+    log.Println("LogLine():", err)
+    CloseGameLog()
+    Logging = false
+    LocalMessage(fmt.Sprintf("Error writing log file; logging stopped: %s", err))
   }
-  DrawInput()
 }
 
-// If possible, populate the command input line with a command from earlier in
-// command the history. Stash the latest command first, if necessary. Redraw
-// the input line.
+// Start logging, reporting where to (or what went wrong).
 //
-func CmdHistBack() {
-  if cmdHistPtr > 0 {
-    if cmdHistPtr == len(cmdHist) {
-      cmdStash = Input
-    }
-    cmdHistPtr--
-    Input = []rune(cmdHist[cmdHistPtr])
-    IP = len(Input)
-    DrawInput()
+func StartLogging() {
+  fname, err := OpenGameLog()
+  if err != nil {
+    Logging = false
+    LocalMessage(fmt.Sprintf("Error opening log file: %s", err))
+    return
   }
+  Logging = true
+  LocalMessage(fmt.Sprintf("Logging to %s", fname))
 }
 
-// If possible, populate the command input line with a command from later in
-// command the history, retrieving the latest command from the stash, if
-// necessary. Redraw the input line.
+// "/log on" and "/log off" start and stop logging; "/log" alone says
+// whether it's on.
 //
-func CmdHistForward() {
-  if cmdHistPtr < len(cmdHist) {
-    cmdHistPtr++
-    if cmdHistPtr == len(cmdHist) {
-      Input = cmdStash
+func LogCmd(args string) {
+  switch strings.ToLower(args) {
+  case "on":
+    if SessionLog == nil {
+      StartLogging()
+    }
+  case "off":
+    if SessionLog != nil {
+      LocalMessage("Logging stopped.")
+      CloseGameLog()
+    }
+    Logging = false
+  case "":
+    if SessionLog != nil {
+      LocalMessage(fmt.Sprintf("Logging to %s", SessionLog.F.Name()))
     } else {
-      Input = []rune(cmdHist[cmdHistPtr])
+      LocalMessage("Not logging.")
     }
-    IP = len(Input)
-    DrawInput()
+  default:
+    LocalMessage("Usage: /log [on|off]")
   }
+  UpdateFootLine()
 }
 
-// Send the current command to the game. Add it to the history if it's long
-// enough, and clear the input line. Redraw the input line.
+// Returns the CSS color for a termbox color Attribute (without attributes),
+// or def if it's the default color.
 //
-func SendCommand() {
-  log.Println("SendCommand():")
-  if len(Input) > 0 {
-    e := Env{ Type: "cmd", Text: string(Input) }
-    ncdr.Encode(e)
-    log.Println("    sent:", e)
-    if len(Input) >= MinCmdLen {
-      if len(cmdHist) == 0 {
-        cmdHist = append(cmdHist, string(Input))
-      } else {
-        cmd_str := string(Input)
-        if cmd_str != cmdHist[len(cmdHist)-1] {
-          cmdHist = append(cmdHist, cmd_str)
-        }
+func CSSColor(c termbox.Attribute, def string) string {
+  c = c &^ AttrMask
+  if c == termbox.ColorDefault {
+    return def
+  }
+  r, g, b := PaletteRGB(int(c) - 1)
+  return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
+
+// Returns the CSS style for text with the given foreground and background,
+// on a page whose default colors are def_fg and def_bg.
+//
+func CSSStyle(fg, bg termbox.Attribute, def_fg, def_bg string) string {
+  fgc, bgc := CSSColor(fg, def_fg), CSSColor(bg, def_bg)
+  attrs := fg | bg
+  if attrs & termbox.AttrReverse != 0 {
+    fgc, bgc = bgc, fgc
+  }
+  style := []string{ "color:" + fgc, "background:" + bgc }
+  if attrs & termbox.AttrBold != 0 {
+    style = append(style, "font-weight:bold")
+  }
+  if attrs & termbox.AttrUnderline != 0 {
+    style = append(style, "text-decoration:underline")
+  }
+  if attrs & termbox.AttrCursive != 0 {
+    style = append(style, "font-style:italic")
+  }
+  if attrs & termbox.AttrDim != 0 {
+    style = append(style, "opacity:0.6")
+  }
+  if attrs & termbox.AttrHidden != 0 {
+    style = append(style, "visibility:hidden")
+  }
+  return strings.Join(style, ";")
+}
+
+// Writes an HTML page to w showing the text from start through end (an
+// end.Cell of -1 means the whole of the last Line), in its colors, with
+// timestamps.
+//
+func WriteHTML(w io.Writer, start, end TextPos) error {
+  def_fg := CSSColor(DefaultFg, "#e5e5e5")
+  def_bg := CSSColor(DefaultBg, "#000000")
+  bw := bufio.NewWriter(w)
+  fmt.Fprintf(bw, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+  fmt.Fprintf(bw, "<title>%s</title>\n", html.EscapeString(HeadLine.String()))
+  fmt.Fprintf(bw, "<style>\n")
+  fmt.Fprintf(bw, "pre.dta5 { color:%s; background:%s; padding:0.5em; ", def_fg, def_bg)
+  fmt.Fprintf(bw, "white-space:pre-wrap; font-family:monospace; }\n")
+  fmt.Fprintf(bw, "pre.dta5 .ts { color:%s; }\n", CSSColor(TimeFg, def_fg))
+  fmt.Fprintf(bw, "</style>\n</head>\n<body>\n<pre class=\"dta5\">")
+  
+  for lidx := start.Line; lidx <= end.Line; lidx++ {
+    l := GetLine(lidx)
+    first, past := 0, len(l.C)
+    if lidx == start.Line && start.Cell < past {
+      first = start.Cell
+    }
+    if lidx == end.Line && end.Cell >= 0 && end.Cell + 1 < past {
+      past = end.Cell + 1
+    }
+    if !l.Time.IsZero() {
+      fmt.Fprintf(bw, "<span class=\"ts\">[%s]</span> ",
+                  html.EscapeString(l.Time.Format(TimestampFormat)))
+    }
+    for n := first; n < past; {
+      fg, bg := l.C[n].Fg, l.C[n].Bg
+      run := make([]rune, 0, past - n)
+      for ; n < past && l.C[n].Fg == fg && l.C[n].Bg == bg; n++ {
+        run = append(run, l.C[n].Ch)
       }
+      fmt.Fprintf(bw, "<span style=\"%s\">%s</span>",
+                  CSSStyle(fg, bg, def_fg, def_bg),
+                  html.EscapeString(string(run)))
     }
-    
-    if len(cmdHist) >= MaxCmdHistSize {
-      new_hist := make([]string, 0, MaxCmdHistSize)
-      new_hist = append(new_hist, cmdHist[len(cmdHist)-MinCmdHistSize:]...)
-      cmdHist = new_hist
+    bw.WriteString("\n")
+  }
+  bw.WriteString("</pre>\n</body>\n</html>\n")
+  return bw.Flush()
+}
+
+// "/export" writes the game window history to an HTML file. "/export N"
+// writes just the newest N Lines, and "/export selection" just the text
+// selected with the mouse. A file name can be given, too; otherwise the
+// file goes in an "exports" directory under DataDir(), named for the
+// current time.
+//
+func ExportCmd(args string) {
+  start, end := TextPos{ FirstLine(), 0 }, TextPos{ NumLines() - 1, -1 }
+  var fname string
+  for _, w := range strings.Fields(args) {
+    if n, err := strconv.Atoi(w); err == nil && n > 0 {
+      if NumLines() - n > start.Line {
+        start.Line = NumLines() - n
+      }
+    } else if strings.ToLower(w) == "selection" {
+      if !HaveSelection {
+        LocalMessage("Nothing is selected.")
+        return
+      }
+      start, end = SelectionRange()
+      // Lines may have been trimmed since the selection was made.
+      if end.Line < FirstLine() {
+        LocalMessage("The selection is no longer available.")
+        return
+      }
+      if start.Line < FirstLine() {
+        start = TextPos{ FirstLine(), 0 }
+      }
+      if end.Line >= NumLines() {
+        end = TextPos{ NumLines() - 1, -1 }
+      }
+    } else {
+      fname = w
     }
-    
-    cmdHistPtr = len(cmdHist)
-    Input = make([]rune, 0, 0)
-    IP = 0
-    DrawInput()
   }
+  if end.Line < start.Line {
+    LocalMessage("Nothing to export.")
+    return
+  }
+  if fname == "" {
+    dir, err := DataDir()
+    if err != nil {
+      LocalMessage(fmt.Sprintf("Error exporting: %s", err))
+      return
+    }
+    fname = filepath.Join(dir, "exports",
+                          time.Now().Format("2006-01-02_15-04-05") + ".html")
+  }
+  if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+    LocalMessage(fmt.Sprintf("Error exporting: %s", err))
+    return
+  }
+  f, err := os.Create(fname)
+  if err != nil {
+    LocalMessage(fmt.Sprintf("Error exporting: %s", err))
+    return
+  }
+  err = WriteHTML(f, start, end)
+  if cerr := f.Close(); err == nil {
+    err = cerr
+  }
+  if err != nil {
+    LocalMessage(fmt.Sprintf("Error exporting: %s", err))
+    return
+  }
+  LocalMessage(fmt.Sprintf("Exported %d lines to %s", end.Line - start.Line + 1,
+                           fname))
+}
+
+// Sets the remembered terminal dimensions to the actual terminal dimensions.
+// Called at initialization and every time the terminal window is resized.
+//
+func Redimension(x, y int) {
+  TermW, TermH = x, y
+  log.Println("Redimension()ing: (", TermW, TermH, ")")
+}
+
+// Recalculates some important values. Called every time Redimension() is.
+//
+func Recalculate() {
+  HeadY  = 0
+  SbackY = 1
+  FootY  = TermH - 2
+  InputY = TermH -1
+  InputRL = (2 * TermW) / 3
+  SbackW = TermW
+  
+  // The chat pane takes its space from the game window, but always leaves
+  // it at least a few rows and a reasonable width.
+  Chat.X, Chat.Y, Chat.W, Chat.H = 0, 0, 0, 0
+  switch ChatPosition {
+  case "top":
+    h := ChatHeight
+    if h > (FootY - SbackY) - 4 {
+      h = (FootY - SbackY) - 4
+    }
+    if h > 0 {
+      Chat.X, Chat.Y, Chat.W, Chat.H = 0, SbackY, TermW, h
+      SbackY = SbackY + h + 1
+    }
+  case "right":
+    w := ChatWidth
+    if w > TermW - 21 {
+      w = TermW - 21
+    }
+    if w > 0 {
+      Chat.X, Chat.Y, Chat.W, Chat.H = TermW - w, SbackY, w, FootY - SbackY
+      SbackW = TermW - w - 1
+    }
+  }
+  
+  TextW  = SbackW
+  TextX  = 0
+  if MaxTextWidth > 0 && MaxTextWidth < SbackW {
+    TextW = MaxTextWidth
+    if CenterText {
+      TextX = (SbackW - TextW) / 2
+    }
+  }
+  
+  // The timestamp gutter goes in the left margin if there's room; otherwise
+  // the text moves over (and gets narrower, if need be) to make room.
+  GutterW = 0
+  if ShowTimestamps {
+    GutterW = runewidth.StringWidth(time.Now().Format(TimestampFormat)) + 1
+    if GutterW > SbackW / 2 {
+      GutterW = 0
+    }
+  }
+  if TextX < GutterW {
+    TextX = GutterW
+    if TextX + TextW > SbackW {
+      TextW = SbackW - TextX
+    }
+  }
+  log.Println("Recalculate()ing: HeadY, SbackY, FootY, InputY, TextW, TextX:",
+              HeadY, SbackY, FootY, InputY, TextW, TextX)
+}
+
+// Draws the Head Line (above the game window). Called when its text changes
+// (and when it starts and stops flashing; see FlashHeadLine()).
+//
+func DrawHeadLine() {
+  cells, fg, bg := HeadLine.C, HeadTailFg, HeadTailBg
+  if time.Now().Before(FlashUntil) {
+    cells = make([]Cell, len(HeadLine.C))
+    for n, c := range HeadLine.C {
+      cells[n] = Cell{ Ch: c.Ch, Fg: c.Fg | termbox.AttrReverse,
+                       Bg: c.Bg | termbox.AttrReverse }
+    }
+    fg, bg = fg | termbox.AttrReverse, bg | termbox.AttrReverse
+  }
+  fence := DrawCells(cells, 0, HeadY, TermW)
+  for n := fence; n < TermW; n++ {
+    termbox.SetCell(n, HeadY, ' ', fg, bg)
+  }
+}
+
+// Draw the Foot line (below the game window). Called when its text changes.
+//
+func DrawFootline() {
+  fence := DrawCells(FootLine.C, 0, FootY, TermW)
+  for n := fence; n < TermW; n++ {
+    termbox.SetCell(n, FootY, ' ', HeadTailFg, HeadTailBg)
+  }
+}
+
+// Rebuild the Foot line from the various bits of status information it
+// displays, then redraw it.
+//
+func UpdateFootLine() {
+  if DEBUG {
+    return
+  }
+  status := make([]string, 0, 0)
+  if GaggedCount > 0 {
+    if RevealGagged {
+      status = append(status, fmt.Sprintf("gagged: %d (shown)", GaggedCount))
+    } else {
+      status = append(status, fmt.Sprintf("gagged: %d", GaggedCount))
+    }
+  }
+  if HScroll > 0 {
+    status = append(status, fmt.Sprintf("scrolled right: %d", HScroll))
+  }
+  if ViewTypes != nil {
+    status = append(status, "view: " + ViewName)
+  }
+  if ScrolledBack() {
+    if n := UnreadCount(); n > 0 {
+      status = append(status, fmt.Sprintf("new: %d", n))
+    }
+    status = append(status, fmt.Sprintf("history: %d%%", ScrollPercent()))
+    if len(RowMap) > 0 && RowMap[0].Line >= FirstLine() {
+      if t := GetLine(RowMap[0].Line).Time; !t.IsZero() {
+        status = append(status, "from " + t.Format(TimestampFormat))
+      }
+    }
+  }
+  if SessionLog != nil {
+    status = append(status, "logging")
+  }
+  if HaveSelection && !Selecting {
+    status = append(status, fmt.Sprintf(
+      "%d characters sent to clipboard (if the terminal allows OSC 52)",
+      CopiedChars))
+  }
+  if SearchRe != nil {
+    more := ""
+    if SearchIncomplete() {
+      more = "+"
+    }
+    if len(SearchHits) == 0 && more != "" {
+      status = append(status, fmt.Sprintf("no recent matches for %q (Ctrl-P looks further back)",
+                                          SearchText))
+    } else if len(SearchHits) == 0 {
+      status = append(status, fmt.Sprintf("no matches for %q", SearchText))
+    } else {
+      status = append(status, fmt.Sprintf("match %d of %d%s", SearchCur + 1,
+                                          len(SearchHits), more))
+    }
+    if more != "" && SearchFrom < LineBase {
+      status = append(status, "searched back to " +
+                      GetLine(SearchFrom).Time.Format(TimestampFormat))
+    }
+  }
+  FootLine = NewLine(" " + strings.Join(status, " | "), HeadTailFg, HeadTailBg)
+  DrawFootline()
+}
+
+// Draw the current command input line. Called when its contents changes.
+//
+// Positions are figured in terminal columns rather than runes, since some
+// characters are two columns wide. If the insertion point would be more
+// than InputRL columns from the left edge, the view scrolls (by whole
+// characters) to keep it there. Any InputPrompt is drawn first, and doesn't
+// scroll.
+//
+func DrawInput() {
+  var n, x int
+  
+  x = 0
+  for _, r := range InputPrompt {
+    termbox.SetCell(x, InputY, r, InputFg | termbox.AttrBold, InputBg)
+    x = x + RuneCols(r)
+  }
+  prompt_w := x
+  
+  // cols[n] is the column at which Input[n] starts (if nothing is scrolled).
+  cols := make([]int, len(Input)+1)
+  for n = 0; n < len(Input); n++ {
+    cols[n+1] = cols[n] + RuneCols(Input[n])
+  }
+  
+  var scroll int = 0
+  for scroll < IP && cols[IP] - cols[scroll] > InputRL - prompt_w {
+    scroll++
+  }
+  
+  for n = scroll; n < len(Input); n++ {
+    w := RuneCols(Input[n])
+    if x + w > TermW {
+      break
+    }
+    if n == IP {
+      termbox.SetCell(x, InputY, Input[n], InputFg | termbox.AttrReverse,
+                                           InputBg | termbox.AttrReverse)
+    } else {
+      termbox.SetCell(x, InputY, Input[n], InputFg, InputBg)
+    }
+    x = x + w
+  }
+  input_end := n
+  if IP == len(Input) && x < TermW {
+    termbox.SetCell(x, InputY, ' ', InputFg | termbox.AttrReverse,
+                                    InputBg | termbox.AttrReverse)
+    x++
+  }
+  for ; x < TermW; x++ {
+    termbox.SetCell(x, InputY, ' ', InputFg, InputBg)
+  }
+  
+  if scroll > 0 {
+    termbox.SetCell(prompt_w, InputY, '<', InputFg | termbox.AttrReverse,
+                                           InputBg | termbox.AttrReverse)
+  }
+  if input_end < len(Input) {
+    termbox.SetCell(TermW - 1, InputY, '>', InputFg | termbox.AttrReverse,
+                                            InputBg | termbox.AttrReverse)
+  }
+}
+
+// Helper function used by DrawScrollback(). After a Line of text has been
+// Wrap()ped, it draws the chunkth row of characters from that line on the
+// yth row of the terminal window. Rows after the first are indented by the
+// Line's Indent. The row starts at column TextX; the margins on either side
+// are filled with blanks, except for the Line's Time in the gutter beside
+// its first row, if timestamps are being shown.
+//
+func DrawLineChunk(l *Line, chunk int, y int) {
+  log.Println("(*Line) DrawLineChunk(): [", l.Starts[chunk], l.Ends[chunk],
+              "], pos:", y, "(", l.String(), ")")
+  var term_x int = 0
+  var text_x int = TextX
+  if chunk > 0 {
+    text_x = text_x + l.Indent
+  }
+  cellz := l.C[l.Starts[chunk]:l.Ends[chunk]]
+  
+  // Preformatted Lines scroll horizontally. If a double-width character
+  // straddles the left edge, its right half is left blank.
+  var clipped_left bool = false
+  if l.Pre && HScroll > 0 {
+    var cols, n int
+    for n < len(cellz) && cols < HScroll {
+      cols = cols + RuneCols(cellz[n].Ch)
+      n++
+    }
+    clipped_left = n > 0
+    text_x = text_x + cols - HScroll
+    cellz = cellz[n:]
+  }
+  
+  for ; term_x < text_x; term_x++ {
+    termbox.SetCell(term_x, y, ' ', DefaultFg, DefaultBg)
+  }
+  if GutterW > 0 && chunk == 0 && !l.Time.IsZero() {
+    gx := TextX - GutterW
+    for _, r := range l.Time.Format(TimestampFormat) {
+      if gx + RuneCols(r) > TextX - 1 {
+        break
+      }
+      termbox.SetCell(gx, y, r, TimeFg, DefaultBg)
+      gx = gx + RuneCols(r)
+    }
+  }
+  term_x = DrawCells(cellz, term_x, y, TextX + TextW)
+  clipped_right := CellCols(cellz) > term_x - text_x
+  for ; term_x < SbackW; term_x++ {
+    termbox.SetCell(term_x, y, ' ', DefaultFg, DefaultBg)
+  }
+  
+  if clipped_left {
+    termbox.SetCell(TextX, y, '<', DefaultFg | termbox.AttrReverse,
+                                   DefaultBg | termbox.AttrReverse)
+  }
+  if clipped_right {
+    termbox.SetCell(TextX + TextW - 1, y, '>', DefaultFg | termbox.AttrReverse,
+                                               DefaultBg | termbox.AttrReverse)
+  }
+}
+
+// Scroll the preformatted Lines in the game window delta columns to the
+// left (negative values scroll right), but not past either end of the widest
+// one currently showing.
+//
+func ScrollHorizontally(delta int) {
+  var widest int = 0
+  for _, r := range RowMap {
+    if r.Line < FirstLine() || r.Line >= NumLines() {
+      continue
+    }
+    if l := GetLine(r.Line); l.Pre {
+      if w := CellCols(l.C); w > widest {
+        widest = w
+      }
+    }
+  }
+  new_hscroll := HScroll + delta
+  if new_hscroll > widest - TextW {
+    new_hscroll = widest - TextW
+  }
+  if new_hscroll < 0 {
+    new_hscroll = 0
+  }
+  if new_hscroll != HScroll {
+    HScroll = new_hscroll
+    DrawScrollback()
+    UpdateFootLine()
+  }
+}
+
+// Clear the terminal and redraw everything. Used when the terminal is resized
+// or the colors change.
+//
+func RedrawAll() {
+  termbox.Clear(DefaultFg, DefaultBg)
+  DrawHeadLine()
+  DrawChatBar()
+  Chat.Draw()
+  DrawScrollback()
+  DrawFootline()
+  DrawInput()
+}
+
+// Returns whether the game window is scrolled back from the newest text.
+//
+func ScrolledBack() bool {
+  return ViewLine >= 0
+}
+
+// Returns the number of rows the given Line occupies in the game window,
+// wrapping it first if it isn't already wrapped to the current text width.
+//
+func LineRows(l *Line) int {
+  if !Shown(l) {
+    return 0
+  }
+  if l.Width != TextW {
+    l.Wrap(TextW)
+  }
+  return l.Len() + MarkerRows(l)
+}
+
+// Returns the number of rows drawn above the given Line's text: 1 for the
+// unread-text marker, if it has one, otherwise 0.
+//
+func MarkerRows(l *Line) int {
+  if l.Marker {
+    return 1
+  }
+  return 0
+}
+
+// Returns the position (Line index and row) of the newest row of text. The
+// Line index is -1 if there's no text at all.
+//
+func NewestRow() (int, int) {
+  lidx := PrevShown(NumLines())
+  if lidx < 0 {
+    return -1, 0
+  }
+  return lidx, LineRows(GetLine(lidx)) - 1
+}
+
+// Returns the position n rows older than row ridx of Line lidx, or the
+// oldest row, if there aren't that many.
+//
+func RowsBack(lidx, ridx, n int) (int, int) {
+  for n > ridx {
+    n = n - (ridx + 1)
+    prev := PrevShown(lidx)
+    if prev < 0 {
+      return lidx, 0
+    }
+    lidx = prev
+    ridx = LineRows(GetLine(lidx)) - 1
+  }
+  return lidx, ridx - n
+}
+
+// Returns the position n rows newer than row ridx of Line lidx, or the
+// newest row, if there aren't that many.
+//
+func RowsForward(lidx, ridx, n int) (int, int) {
+  ridx = ridx + n
+  for lidx < NumLines() {
+    rows := LineRows(GetLine(lidx))
+    if ridx < rows {
+      return lidx, ridx
+    }
+    ridx = ridx - rows
+    lidx = NextShown(lidx)
+  }
+  return NewestRow()
+}
+
+// Returns whether the position (alidx, aridx) is older than (blidx, bridx).
+//
+func RowBefore(alidx, aridx, blidx, bridx int) bool {
+  return alidx < blidx || (alidx == blidx && aridx < bridx)
+}
+
+// Scroll the game window so that the given row is at the bottom, without
+// going so far back that there'd be empty space at the top, and switching
+// back to following the newest text if that's where it ends up.
+//
+func ScrollTo(lidx, ridx int) {
+  if NumLines() == FirstLine() {
+    ViewLine = -1
+    return
+  }
+  flidx, fridx := RowsForward(FirstLine(), 0, HistoryRows() - 1)
+  if RowBefore(lidx, ridx, flidx, fridx) {
+    lidx, ridx = flidx, fridx
+  }
+  nlidx, nridx := NewestRow()
+  if !RowBefore(lidx, ridx, nlidx, nridx) {
+    ViewLine, ViewRow = -1, 0
+  } else {
+    ViewLine, ViewRow = lidx, ridx
+  }
+}
+
+// Returns the most rows the bottom ("live") part of the split game window
+// can have: about half as many as the history part above it gets, so the
+// history always keeps most of the window.
+//
+func MaxSplitLiveRows() int {
+  return (FootY - SbackY - 1) / 3
+}
+
+// Returns the number of rows in the bottom ("live") part of the game window
+// when it's split, or 0 if it never is (because SplitView is false, or the
+// window is too small). See SplitRows.
+//
+func SplitLiveRows() int {
+  max := MaxSplitLiveRows()
+  if !SplitView || SplitRows < 1 || max < 1 {
+    return 0
+  }
+  if SplitRows > max {
+    return max
+  }
+  return SplitRows
+}
+
+// Returns whether the game window is currently split: the game window
+// history has been scrolled back, but the newest rows are still shown.
+//
+func Splitting() bool {
+  return ScrolledBack() && SplitLiveRows() > 0
+}
+
+// Returns the row of the bar separating the two parts of the split game
+// window.
+//
+func SplitY() int {
+  return FootY - SplitLiveRows() - 1
+}
+
+// Returns the number of rows of the game window that show the history when
+// it has been scrolled back.
+//
+func HistoryRows() int {
+  if live := SplitLiveRows(); live > 0 {
+    return (FootY - SbackY) - live - 1
+  }
+  return FootY - SbackY
+}
+
+// Returns the number of rows of the game window that scrolling moves
+// through right now.
+//
+func ViewRows() int {
+  if Splitting() {
+    return HistoryRows()
+  }
+  return FootY - SbackY
+}
+
+// The game window can show just some types of text (see TextEnvTypes).
+// ViewTypes holds the types being shown (nil means all of them), and
+// ViewName describes them. Lines the client adds itself (which have no Type)
+// are always shown.
+var ViewTypes map[string]bool
+var ViewName = "all"
+// Named sets of types to view; F6 cycles through them. A set is a list of
+// types to show, or of types (each preceded by '-') to hide.
+var ViewModes = [][2]string{
+  { "all",      "" },
+  { "speech",   "speech" },
+  { "nosys",    "-sys" },
+  { "commands", "echo txt pre" },
+}
+
+// When some types of text are hidden (ViewTypes isn't nil), ViewIndex holds
+// the global indices (oldest first) of the Lines that are shown, so drawing
+// and scrolling can skip over hidden Lines without looking at each one. It's
+// rebuilt by SetView() and added to by AddLine().
+var ViewIndex = make([]int, 0, 0)
+
+// Returns whether Lines of the given type are shown in the current view.
+//
+func ShownType(t string) bool {
+  return ViewTypes == nil || t == "" || ViewTypes[t]
+}
+
+// Returns whether the given Line is shown in the current view.
+//
+func Shown(l *Line) bool {
+  return ShownType(l.Type)
+}
+
+// Returns the Type of the Line with global index lidx, without reading the
+// Line back from the ScrollStore.
+//
+func LineType(lidx int) string {
+  if lidx >= LineBase {
+    return Lines[lidx - LineBase].Type
+  }
+  return ScrollStore.Types[lidx]
+}
+
+// Rebuild ViewIndex for the current ViewTypes.
+//
+func BuildViewIndex() {
+  ViewIndex = make([]int, 0, 0)
+  if ViewTypes == nil {
+    return
+  }
+  for lidx := FirstLine(); lidx < NumLines(); lidx++ {
+    if ShownType(LineType(lidx)) {
+      ViewIndex = append(ViewIndex, lidx)
+    }
+  }
+}
+
+// Returns the global index of the newest shown Line older than lidx, or -1
+// if there isn't one.
+//
+func PrevShown(lidx int) int {
+  if ViewTypes == nil {
+    if lidx - 1 < FirstLine() {
+      return -1
+    }
+    return lidx - 1
+  }
+  n := sort.SearchInts(ViewIndex, lidx) - 1
+  if n < 0 || ViewIndex[n] < FirstLine() {
+    return -1
+  }
+  return ViewIndex[n]
+}
+
+// Returns the global index of the oldest shown Line newer than lidx, or
+// NumLines() if there isn't one.
+//
+func NextShown(lidx int) int {
+  if lidx + 1 < FirstLine() {
+    lidx = FirstLine() - 1
+  }
+  if ViewTypes == nil {
+    if lidx + 1 > NumLines() {
+      return NumLines()
+    }
+    return lidx + 1
+  }
+  n := sort.SearchInts(ViewIndex, lidx + 1)
+  if n == len(ViewIndex) {
+    return NumLines()
+  }
+  return ViewIndex[n]
+}
+
+// Returns the set of types described by spec (a list of types to show, or
+// types preceded by '-' to hide), or nil for all of them.
+//
+func ParseViewTypes(spec string) (map[string]bool, error) {
+  words := strings.Fields(strings.ToLower(strings.Replace(spec, ",", " ", -1)))
+  if len(words) == 0 {
+    return nil, nil
+  }
+  types := make(map[string]bool)
+  if strings.HasPrefix(words[0], "-") {
+    for t := range TextEnvTypes {
+      types[t] = true
+    }
+  }
+  for _, w := range words {
+    hide := strings.HasPrefix(w, "-")
+    w = strings.TrimPrefix(w, "-")
+    if !TextEnvTypes[w] {
+      return nil, fmt.Errorf("unknown type %q", w)
+    }
+    types[w] = !hide
+  }
+  return types, nil
+}
+
+// Show only the given types of text in the game window (see
+// ParseViewTypes()), keeping the view scrolled to the same place, or as
+// near it as possible, and redraw.
+//
+func SetView(name string, types map[string]bool) {
+  ViewName, ViewTypes = name, types
+  BuildViewIndex()
+  RefreshSearch()
+  if ScrolledBack() {
+    // If the Line at the bottom is now hidden, use the nearest older one
+    // that isn't (or the nearest newer one, if there isn't one).
+    lidx, ridx := ViewLine, ViewRow
+    if !ShownType(LineType(lidx)) {
+      if lidx = PrevShown(ViewLine); lidx >= 0 {
+        ridx = -1
+      } else {
+        lidx, ridx = NextShown(ViewLine), 0
+      }
+    }
+    if lidx < NumLines() {
+      if rows := LineRows(GetLine(lidx)); ridx < 0 || ridx >= rows {
+        ridx = rows - 1
+      }
+      ScrollTo(lidx, ridx)
+    } else {
+      ViewLine = -1
+    }
+  }
+  HScroll = 0
+  RedrawAll()
+}
+
+// "/view name" switches to one of the ViewModes; "/view" followed by types
+// (or '-'-prefixed types) shows just those types (or hides them); "/view"
+// alone lists the ViewModes.
+//
+func ViewCmd(args string) {
+  if args == "" {
+    names := make([]string, 0, len(ViewModes))
+    for _, m := range ViewModes {
+      names = append(names, m[0])
+    }
+    LocalMessage(fmt.Sprintf("Current view: %s; views: %s (or list types " +
+                             "to show, or -types to hide)", ViewName,
+                             strings.Join(names, ", ")))
+    return
+  }
+  spec := args
+  for _, m := range ViewModes {
+    if strings.ToLower(args) == m[0] {
+      spec = m[1]
+    }
+  }
+  types, err := ParseViewTypes(spec)
+  if err != nil {
+    LocalMessage(fmt.Sprintf("Bad view: %s", err))
+    return
+  }
+  SetView(strings.ToLower(args), types)
+}
+
+// Switch to the next of the ViewModes.
+//
+func CycleView() {
+  next := 0
+  for n, m := range ViewModes {
+    if m[0] == ViewName {
+      next = (n + 1) % len(ViewModes)
+    }
+  }
+  types, _ := ParseViewTypes(ViewModes[next][1])
+  SetView(ViewModes[next][0], types)
+}
+
+// Turn showing timestamps beside the game text on or off.
+//
+func ToggleTimestamps() {
+  ShowTimestamps = !ShowTimestamps
+  Recalculate()
+  RedrawAll()
+}
+
+// Returns the position of the row at the bottom of the game window (or
+// the top part of it, if it's split).
+//
+func BottomRow() (int, int) {
+  if !ScrolledBack() {
+    return NewestRow()
+  }
+  return ViewLine, ViewRow
+}
+
+// Scroll the game window history n rows backward (if possible).
+//
+func ScrollBackwardRows(n int) {
+  if CanScrollBack {
+    lidx, ridx := BottomRow()
+    ScrollTo(RowsBack(lidx, ridx, n))
+    DrawScrollback()
+  }
+}
+
+// Scroll the game window history n rows forward (if possible).
+//
+func ScrollForwardRows(n int) {
+  if ScrolledBack() {
+    ScrollTo(RowsForward(ViewLine, ViewRow, n))
+    DrawScrollback()
+  }
+}
+
+// Returns the number of rows in half the game window (or the part of it
+// showing the history), but at least one.
+//
+func HalfScreen() int {
+  half := ViewRows() / 2
+  if half < 1 {
+    half = 1
+  }
+  return half
+}
+
+// Scroll the game window history one screen backward (if possible).
+//
+func ScrollBackward() {
+  ScrollBackwardRows(ViewRows() - ScrollbackOverlap)
+}
+
+// Scroll the game window history one screen forward (if possible).
+//
+func ScrollForward() {
+  ScrollForwardRows(ViewRows() - ScrollbackOverlap)
+}
+
+// Jump the game window history to the most recent messaging.
+//
+func ScrollToFront() {
+  if ScrolledBack() {
+    ViewLine = -1
+    DrawScrollback()
+  }
+}
+
+// Jump the game window history to the oldest text there is.
+//
+func ScrollToBack() {
+  if CanScrollBack {
+    ScrollTo(FirstLine(), 0)
+    DrawScrollback()
+  }
+}
+
+// Returns how far through the game window history the bottom of the game
+// window is, as a percentage of its Lines.
+//
+func ScrollPercent() int {
+  if !ScrolledBack() || NumLines() == FirstLine() {
+    return 100
+  }
+  return 100 * (ViewLine - FirstLine() + 1) / (NumLines() - FirstLine())
+}
+
+// A SearchHit is a match of the current search: Cells Start up to (but not
+// including) End of the Line with global index Line.
+//
+type SearchHit struct {
+  Line  int
+  Start int
+  End   int
+}
+
+// The current search of the game window history (nil if there isn't one),
+// the text that was searched for, every match (oldest first), and which
+// match is being shown (-1 for none). New Lines are searched as they arrive.
+var SearchRe *regexp.Regexp
+var SearchText string
+var SearchHits = make([]SearchHit, 0, 0)
+var SearchCur int = -1
+// Global index of the oldest Line searched so far. A new search only looks
+// through the Lines in memory; older ones (in the ScrollStore) are searched
+// SearchChunk at a time, when stepping back past the oldest match.
+var SearchFrom int = 0
+const SearchChunk = 5000
+// Whether the search prompt is being shown in the input line, and where the
+// command being entered is kept in the meantime.
+var SearchPrompting = false
+var searchStash []rune
+var searchStashIP int
+
+// Show the search prompt in the input line, prefilled with the previous
+// search text.
+//
+func StartSearchPrompt() {
+  if SearchPrompting {
+    return
+  }
+  SearchPrompting = true
+  searchStash, searchStashIP = Input, IP
+  Input = []rune(SearchText)
+  IP = len(Input)
+  InputPrompt = "Search (Ctrl-G cancels): "
+  DrawInput()
+}
+
+// Put the command being entered back in the input line. If run is true,
+// search for what was typed at the prompt.
+//
+func EndSearchPrompt(run bool) {
+  text := string(Input)
+  SearchPrompting = false
+  Input, IP = searchStash, searchStashIP
+  searchStash = nil
+  InputPrompt = ""
+  DrawInput()
+  if run && text != "" {
+    RunSearch(text)
+  }
+}
+
+// Compile search text into a Regexp. Text between slashes ("/like this/")
+// is a regular expression; anything else is searched for literally,
+// ignoring case.
+//
+func CompileSearch(text string) (*regexp.Regexp, error) {
+  if len(text) > 1 && strings.HasPrefix(text, "/") && strings.HasSuffix(text, "/") {
+    return regexp.Compile(text[1:len(text)-1])
+  }
+  return regexp.Compile("(?i)" + regexp.QuoteMeta(text))
+}
+
+// Search the game window history in memory for text, and show the newest
+// match at or above the bottom of the game window (or the oldest match, if
+// they're all below it). See SearchOlder() for the rest of the history.
+//
+func RunSearch(text string) {
+  re, err := CompileSearch(text)
+  if err != nil {
+    LocalMessage(fmt.Sprintf("Bad search pattern %q: %s", text, err))
+    return
+  }
+  SearchRe, SearchText = re, text
+  SearchHits = make([]SearchHit, 0, 0)
+  SearchCur = -1
+  SearchFrom = LineBase
+  for lidx := LineBase; lidx < NumLines(); lidx++ {
+    SearchLine(lidx, GetLine(lidx))
+  }
+  if len(SearchHits) == 0 {
+    UpdateFootLine()
+    DrawScrollback()
+    return
+  }
+  blidx, _ := BottomRow()
+  n := sort.Search(len(SearchHits), func(i int) bool {
+    return SearchHits[i].Line > blidx
+  })
+  if n > 0 {
+    n--
+  }
+  ShowSearchHit(n)
+}
+
+// Add any matches of the current search in the given Line (with global
+// index lidx) to SearchHits, unless the current view hides it.
+//
+func SearchLine(lidx int, l *Line) {
+  if !Shown(l) {
+    return
+  }
+  for _, span := range l.FindAll(SearchRe) {
+    SearchHits = append(SearchHits, SearchHit{ lidx, span[0], span[1] })
+  }
+}
+
+// Collect the current search's matches again, for when the view changes
+// (matches in hidden Lines don't count). Only the Lines in memory are
+// searched again (see SearchOlder()); the current match stays on the same
+// Line, or the nearest older one, if it can.
+//
+func RefreshSearch() {
+  if SearchRe == nil {
+    return
+  }
+  cur := NumLines()
+  if SearchCur >= 0 && SearchCur < len(SearchHits) {
+    cur = SearchHits[SearchCur].Line
+  }
+  SearchHits = make([]SearchHit, 0, 0)
+  SearchFrom = LineBase
+  for lidx := LineBase; lidx < NumLines(); lidx++ {
+    SearchLine(lidx, GetLine(lidx))
+  }
+  SearchCur = sort.Search(len(SearchHits), func(i int) bool {
+    return SearchHits[i].Line > cur
+  }) - 1
+  if SearchCur < 0 && len(SearchHits) > 0 {
+    SearchCur = 0
+  }
+  UpdateFootLine()
+}
+
+// Returns whether there is older history (in the ScrollStore) that the
+// current search hasn't looked through yet.
+//
+func SearchIncomplete() bool {
+  return SearchRe != nil && SearchFrom > FirstLine()
+}
+
+// Search the next SearchChunk Lines older than SearchFrom, adding any
+// matches to the beginning of SearchHits (and adjusting SearchCur to
+// match). Returns the number of matches found.
+//
+func SearchOlder() int {
+  stop := SearchFrom - SearchChunk
+  if stop < FirstLine() {
+    stop = FirstLine()
+  }
+  newer := SearchHits
+  SearchHits = make([]SearchHit, 0, 0)
+  for lidx := stop; lidx < SearchFrom; lidx++ {
+    SearchLine(lidx, GetLine(lidx))
+  }
+  found := len(SearchHits)
+  SearchHits = append(SearchHits, newer...)
+  SearchCur = SearchCur + found
+  SearchFrom = stop
+  return found
+}
+
+// Forget about matches in Lines that are no longer available.
+//
+func PruneSearchHits() {
+  n := 0
+  for n < len(SearchHits) && SearchHits[n].Line < FirstLine() {
+    n++
+  }
+  if n > 0 {
+    SearchHits = SearchHits[n:]
+    SearchCur = SearchCur - n
+    if SearchCur < 0 && len(SearchHits) > 0 {
+      SearchCur = 0
+    }
+  }
+}
+
+// Scroll the game window so the nth match is in the middle of it.
+//
+func ShowSearchHit(n int) {
+  SearchCur = n
+  h := SearchHits[n]
+  l := GetLine(h.Line)
+  ridx := LineRows(l) - MarkerRows(l) - 1
+  for ridx > 0 && l.Starts[ridx] > h.Start {
+    ridx--
+  }
+  ScrollTo(RowsForward(h.Line, ridx + MarkerRows(l), HistoryRows() / 2))
+  UpdateFootLine()
+  DrawScrollback()
+}
+
+// Step delta matches forward (toward newer text) or backward, stopping at
+// either end. Stepping back past the oldest match searches further back
+// through the history (see SearchOlder()).
+//
+func StepSearch(delta int) {
+  if SearchRe == nil {
+    return
+  }
+  if len(SearchHits) == 0 {
+    if delta < 0 && SearchIncomplete() && SearchOlder() > 0 {
+      ShowSearchHit(len(SearchHits) - 1)
+    } else {
+      UpdateFootLine()
+    }
+    return
+  }
+  n := SearchCur + delta
+  if n < 0 && SearchIncomplete() {
+    n = n + SearchOlder()
+  }
+  if n < 0 {
+    n = 0
+  } else if n >= len(SearchHits) {
+    n = len(SearchHits) - 1
+  }
+  ShowSearchHit(n)
+}
+
+// Forget the current search, and go back to following the newest text.
+//
+func EndSearch() {
+  SearchRe, SearchText = nil, ""
+  SearchHits = make([]SearchHit, 0, 0)
+  SearchCur = -1
+  ViewLine = -1
+  UpdateFootLine()
+  DrawScrollback()
+}
+
+// Returns the given Line (with global index lidx) as it should be drawn:
+// if it has any matches of the current search, a copy with the matches in
+// reverse video (and the current match underlined, too).
+//
+func SearchHighlight(lidx int, l *Line) *Line {
+  if SearchRe == nil {
+    return l
+  }
+  n := sort.Search(len(SearchHits), func(i int) bool {
+    return SearchHits[i].Line >= lidx
+  })
+  if n == len(SearchHits) || SearchHits[n].Line != lidx {
+    return l
+  }
+  hl := *l
+  hl.C = make([]Cell, len(l.C))
+  copy(hl.C, l.C)
+  for ; n < len(SearchHits) && SearchHits[n].Line == lidx; n++ {
+    attr := termbox.AttrReverse
+    if n == SearchCur {
+      attr = attr | termbox.AttrUnderline | termbox.AttrBold
+    }
+    for c := SearchHits[n].Start; c < SearchHits[n].End && c < len(hl.C); c++ {
+      hl.C[c].Fg = hl.C[c].Fg | attr
+      hl.C[c].Bg = hl.C[c].Bg | termbox.AttrReverse
+    }
+  }
+  return &hl
+}
+
+// Draw the game window.
+//
+// Overview:
+//
+// Starting with the Line at the bottom of the game window (the newest Line,
+// unless the window has been scrolled back; see ViewLine):
+//   * Wrap() it if it is not already wrapped to the current text width.
+//   * Write its rows to the terminal, starting from the bottom-most row
+//     and working upward.
+// Repeat with the next-older Line, continuing until either the top of the
+// game window has been reached, or the text of all the lines has been
+// written.
+//
+// If the game window is split (see Splitting()), the newest rows are drawn
+// this way in the bottom part, and the history being read in the top part.
+//
+// Only the Lines that actually appear in the game window are ever looked at,
+// so the time this takes depends only on the size of the window.
+//
+func DrawScrollback() {
+  log.Println("DrawScrollback() called...")
+  PlaceMarker()
+  if UnreadSpeech > 0 && !ScrolledBack() {
+    UnreadSpeech = 0
+    UpdateTitle()
+  }
+  RowMap = RowMap[:0]
+  for n := SbackY; n < FootY; n++ {
+    RowMap = append(RowMap, RowPos{ -1, 0 })
+  }
+  
+  bottom := FootY
+  if Splitting() {
+    bottom = SplitY()
+    nlidx, nridx := NewestRow()
+    DrawRows(bottom + 1, FootY, nlidx, nridx)
+    DrawSplitBar(bottom)
+  }
+  lidx, ridx := BottomRow()
+  if lidx >= 0 && ridx >= LineRows(GetLine(lidx)) {
+    // The window's been resized since we scrolled here, and this Line
+    // doesn't have as many rows anymore.
+    ridx = LineRows(GetLine(lidx)) - 1
+  }
+  lidx = DrawRows(SbackY, bottom, lidx, ridx)
+  CanScrollBack = lidx >= FirstLine()
+  UpdateFootLine()
+  
+  if ScrolledBack() {
+    termbox.SetCell(SbackW-1, bottom-1, 'v', DefaultFg | termbox.AttrReverse,
+                                             DefaultBg | termbox.AttrReverse)
+  }
+  if CanScrollBack {
+    termbox.SetCell(SbackW-1, SbackY, '^', DefaultFg | termbox.AttrReverse,
+                                           DefaultBg | termbox.AttrReverse)
+  }
+  
+  log.Println("...DrawScrollback() finished")
+}
+
+// Helper function used by DrawScrollback(). Draws text on terminal rows top
+// up to (but not including) bottom, with row ridx of Line lidx on the
+// bottom one, and blanks any rows left over at the top. Returns the index
+// of the newest Line with rows that didn't fit (which is less than
+// FirstLine() if they all did).
+//
+func DrawRows(top, bottom, lidx, ridx int) int {
+  yp := bottom - 1
+  var cur_line *Line
+  
+  for (yp >= top) && (lidx >= FirstLine()) {
+    log.Println("yp, lidx:", yp, lidx)
+    
+    cur_line = GetLine(lidx)
+    if ridx < 0 {
+      ridx = LineRows(cur_line) - 1
+    }
+    cur_line = SelectionHighlight(lidx, SearchHighlight(lidx, cur_line))
+    for ; (ridx >= 0) && (yp >= top); ridx-- {
+      if ridx < MarkerRows(cur_line) {
+        DrawMarker(cur_line, yp)
+      } else {
+        chunk := ridx - MarkerRows(cur_line)
+        DrawLineChunk(cur_line, chunk, yp)
+        RowMap[yp - SbackY] = RowPos{ lidx, chunk }
+      }
+      yp--
+    }
+    if ridx < 0 {
+      lidx = PrevShown(lidx)
+    }
+  }
+  
+  for yp >= top {
+    for n := 0; n < SbackW; n++ {
+      termbox.SetCell(n, yp, ' ', DefaultFg, DefaultBg)
+    }
+    yp--
+  }
+  return lidx
+}
+
+// Draw the unread-text marker above the given Line on row y.
+//
+func DrawMarker(l *Line, y int) {
+  label := " new "
+  if !l.Time.IsZero() {
+    label = fmt.Sprintf(" new since %s ", l.Time.Format(TimestampFormat))
+  }
+  runes := []rune(label)
+  x := TextX
+  for n := 0; n < SbackW; n++ {
+    termbox.SetCell(n, y, ' ', DefaultFg, DefaultBg)
+  }
+  for n := 0; n < TextW; n++ {
+    var r rune = '-'
+    if n >= 4 && n - 4 < len(runes) {
+      r = runes[n - 4]
+    }
+    termbox.SetCell(x + n, y, r, SysFg, SysBg)
+  }
+}
+
+// Draw the bar between the two parts of a split game window on row y.
+//
+func DrawSplitBar(y int) {
+  label := []rune(" live ")
+  for n := 0; n < SbackW; n++ {
+    var r rune = '-'
+    if n >= 2 && n - 2 < len(label) {
+      r = label[n - 2]
+    }
+    termbox.SetCell(n, y, r, HeadTailFg, HeadTailBg)
+  }
+}
+
+// A ChatPane is a second, smaller text window that gets a copy of every
+// speech (and, optionally, wall) Line, so conversation doesn't get lost
+// among everything else. It has its own (in-memory only) history, which
+// scrolls independently of the game window's: View is -1 when the newest
+// text is at the bottom, and otherwise row Row of Lines[View] is. X, Y, W,
+// and H give the pane's position and size on the terminal (W and H are 0
+// when it isn't shown); see Recalculate().
+//
+type ChatPane struct {
+  Lines []*Line
+  View  int
+  Row   int
+  X, Y  int
+  W, H  int
+}
+
+var Chat = &ChatPane{ Lines: make([]*Line, 0, 0), View: -1 }
+
+// (*ChatPane) Shown() returns whether the pane has room to be drawn.
+//
+func (p *ChatPane) Shown() bool {
+  return p.W > 0 && p.H > 0
+}
+
+// (*ChatPane) Add() adds a Line to the pane, trimming its history the same
+// way AddLine() trims the game window's (but without keeping anything on
+// disk).
+//
+func (p *ChatPane) Add(l *Line) {
+  if len(p.Lines) >= MaxScrollbackLines {
+    dropped := len(p.Lines) - MinScrollbackLines
+    new_lines := make([]*Line, 0, MaxScrollbackLines)
+    new_lines = append(new_lines, p.Lines[dropped:]...)
+    p.Lines = new_lines
+    if p.View >= 0 {
+      p.View = p.View - dropped
+      if p.View < 0 {
+        p.View, p.Row = 0, 0
+      }
+    }
+  }
+  if l.Time.IsZero() {
+    l.Time = time.Now()
+  }
+  p.Lines = append(p.Lines, l)
+}
+
+// Returns the number of rows Lines[n] occupies in the pane.
+//
+func (p *ChatPane) rows(n int) int {
+  if p.Lines[n].Width != p.W {
+    p.Lines[n].Wrap(p.W)
+  }
+  return p.Lines[n].Len()
+}
+
+// Returns the position of the row at the bottom of the pane (the Line
+// index is -1 if there are no Lines).
+//
+func (p *ChatPane) bottom() (int, int) {
+  if p.View < 0 {
+    n := len(p.Lines) - 1
+    if n < 0 {
+      return -1, 0
+    }
+    return n, p.rows(n) - 1
+  }
+  if rows := p.rows(p.View); p.Row >= rows {
+    return p.View, rows - 1
+  }
+  return p.View, p.Row
+}
+
+// Returns the position n rows newer (or, if n is negative, older) than row
+// ridx of Lines[lidx], and how many rows short of that it had to stop
+// because it ran out of Lines.
+//
+func (p *ChatPane) step(lidx, ridx, n int) (int, int, int) {
+  for ; n < 0; n++ {
+    if ridx > 0 {
+      ridx--
+    } else if lidx > 0 {
+      lidx--
+      ridx = p.rows(lidx) - 1
+    } else {
+      break
+    }
+  }
+  for ; n > 0; n-- {
+    if ridx < p.rows(lidx) - 1 {
+      ridx++
+    } else if lidx < len(p.Lines) - 1 {
+      lidx++
+      ridx = 0
+    } else {
+      break
+    }
+  }
+  return lidx, ridx, n
+}
+
+// (*ChatPane) Scroll() scrolls the pane delta rows forward (or, if delta is
+// negative, backward), without going so far back that there'd be empty
+// space at the top, and redraws it.
+//
+func (p *ChatPane) Scroll(delta int) {
+  lidx, ridx := p.bottom()
+  if lidx < 0 || !p.Shown() {
+    return
+  }
+  lidx, ridx, _ = p.step(lidx, ridx, delta)
+  if _, _, short := p.step(lidx, ridx, -(p.H - 1)); short < 0 {
+    lidx, ridx, _ = p.step(lidx, ridx, -short)
+  }
+  if lidx == len(p.Lines) - 1 && ridx == p.rows(lidx) - 1 {
+    p.View, p.Row = -1, 0
+  } else {
+    p.View, p.Row = lidx, ridx
+  }
+  p.Draw()
+}
+
+// (*ChatPane) Draw() draws the pane, newest rows at the bottom, the same
+// way DrawScrollback() draws the game window.
+//
+func (p *ChatPane) Draw() {
+  if !p.Shown() {
+    return
+  }
+  y := p.Y + p.H - 1
+  lidx, ridx := p.bottom()
+  for y >= p.Y && lidx >= 0 {
+    l := p.Lines[lidx]
+    if ridx < 0 {
+      ridx = p.rows(lidx) - 1
+    }
+    for ; ridx >= 0 && y >= p.Y; ridx-- {
+      x := p.X
+      if ridx > 0 {
+        for ; x < p.X + l.Indent; x++ {
+          termbox.SetCell(x, y, ' ', DefaultFg, DefaultBg)
+        }
+      }
+      x = DrawCells(l.C[l.Starts[ridx]:l.Ends[ridx]], x, y, p.X + p.W)
+      for ; x < p.X + p.W; x++ {
+        termbox.SetCell(x, y, ' ', DefaultFg, DefaultBg)
+      }
+      y--
+    }
+    if ridx < 0 {
+      lidx--
+    }
+  }
+  for ; y >= p.Y; y-- {
+    for x := p.X; x < p.X + p.W; x++ {
+      termbox.SetCell(x, y, ' ', DefaultFg, DefaultBg)
+    }
+  }
+  if p.View >= 0 {
+    termbox.SetCell(p.X + p.W - 1, p.Y + p.H - 1, 'v',
+                    DefaultFg | termbox.AttrReverse,
+                    DefaultBg | termbox.AttrReverse)
+  }
+}
+
+// (*ChatPane) Contains() returns whether terminal position (x, y) is in
+// the pane.
+//
+func (p *ChatPane) Contains(x, y int) bool {
+  return x >= p.X && x < p.X + p.W && y >= p.Y && y < p.Y + p.H
+}
+
+// Draw the bar separating the chat pane from the game window: a row below
+// it if it's on top, a column to its left if it's on the right.
+//
+func DrawChatBar() {
+  if !Chat.Shown() {
+    return
+  }
+  if Chat.X > 0 {
+    for y := Chat.Y; y < Chat.Y + Chat.H; y++ {
+      termbox.SetCell(Chat.X - 1, y, '|', HeadTailFg, HeadTailBg)
+    }
+    return
+  }
+  label := []rune(" chat ")
+  y := Chat.Y + Chat.H
+  for n := 0; n < TermW; n++ {
+    var r rune = '-'
+    if n >= 2 && n - 2 < len(label) {
+      r = label[n - 2]
+    }
+    termbox.SetCell(n, y, r, HeadTailFg, HeadTailBg)
+  }
+}
+
+// Returns whether Lines arriving in Envs of type etype get copied to the
+// chat pane.
+//
+func ChatWants(etype string) bool {
+  if ChatPosition != "top" && ChatPosition != "right" {
+    return false
+  }
+  return etype == "speech" || (etype == "wall" && ChatWall)
+}
+
+// Insert a character into the current command and redraw the input line.
+//
+func InsertInInput(r rune) {
+  if IP == len(Input) {
+    Input = append(Input, r)
+  } else {
+    new_input := make([]rune, 0, len(Input)+1)
+    new_input = append(new_input, Input[:IP]...)
+    new_input = append(new_input, r)
+    new_input = append(new_input, Input[IP:]...)
+    Input = new_input
+  }
+  IP++
+  
+  DrawInput()
+}
+
+// If possible, delete the character to the left of the insertion point in
+// the current command, then redraw the input line.
+//
+func InputBackspace() {
+  if IP > 0 {
+    Input = append(Input[:IP-1], Input[IP:]...)
+    IP--
+    DrawInput()
+  }
+}
+
+// If possible, delete the character at the insertion point in the current
+// command, then redraw the input line.
+//
+func InputDelete() {
+  if IP < len(Input) {
+    Input = append(Input[:IP], Input[IP+1:]...)
+    DrawInput()
+  }
+}
+
+// Move the insertion point in the current command right delta characters
+// (negative values of delta will move the IP left). Bound movement so that
+// the IP doesn't go beyond the beginning or end of the current command.
+// Redraw the input line.
+//
+func MoveInputIp(delta int) {
+  new_ip := IP + delta
+  if new_ip < 0 {
+    IP = 0
+  } else if new_ip > len(Input) {
+    IP = len(Input)
+  } else {
+    IP = new_ip
+  }
+  DrawInput()
+}
+
+// If possible, populate the command input line with a command from earlier in
+// command the history. Stash the latest command first, if necessary. Redraw
+// the input line.
+//
+func CmdHistBack() {
+  if cmdHistPtr > 0 {
+    if cmdHistPtr == len(cmdHist) {
+      cmdStash = Input
+    }
+    cmdHistPtr--
+    Input = []rune(cmdHist[cmdHistPtr])
+    IP = len(Input)
+    DrawInput()
+  }
+}
+
+// If possible, populate the command input line with a command from later in
+// command the history, retrieving the latest command from the stash, if
+// necessary. Redraw the input line.
+//
+func CmdHistForward() {
+  if cmdHistPtr < len(cmdHist) {
+    cmdHistPtr++
+    if cmdHistPtr == len(cmdHist) {
+      Input = cmdStash
+    } else {
+      Input = []rune(cmdHist[cmdHistPtr])
+    }
+    IP = len(Input)
+    DrawInput()
+  }
+}
+
+// A TextPos is the position of a Cell in the game window history: Cell
+// Cell of the Line with global index Line.
+//
+type TextPos struct {
+  Line int
+  Cell int
+}
+
+// Returns whether TextPos a comes before b.
+//
+func (a TextPos) Before(b TextPos) bool {
+  return a.Line < b.Line || (a.Line == b.Line && a.Cell < b.Cell)
+}
+
+// Which row of which Line is drawn on each row of the game window
+// (RowMap[0] is the top one); the Line is -1 for blank rows. Set by
+// DrawScrollback(), and used to figure out what's been clicked on.
+//
+type RowPos struct {
+  Line int
+  Row  int
+}
+var RowMap = make([]RowPos, 0, 0)
+
+// Whether the mouse is used for scrolling and selecting text (if not, the
+// terminal's own selection works), and how many rows a turn of the mouse
+// wheel scrolls.
+var MouseCapture = true
+var MouseWheelRows = 3
+// Text selected with the mouse runs from SelAnchor (where the button was
+// pressed) to SelHead (where it is now, or was released), inclusive.
+// Selecting is true while the button is down.
+var SelAnchor, SelHead TextPos
+var HaveSelection = false
+var Selecting = false
+// Whether the bar between the parts of the split game window is being
+// dragged.
+var DraggingSplit = false
+// The number of characters last sent to the clipboard. (Whether the
+// terminal actually put them there can't be known; see CopyToClipboard().)
+var CopiedChars int = 0
+
+// Turn mouse input on or off.
+//
+func SetMouseCapture(on bool) {
+  MouseCapture = on
+  if on {
+    termbox.SetInputMode(termbox.InputAlt | termbox.InputMouse)
+  } else {
+    termbox.SetInputMode(termbox.InputAlt)
+  }
+}
+
+// "/mouse on" and "/mouse off" turn mouse capture on and off; "/mouse"
+// alone toggles it.
+//
+func MouseCmd(args string) {
+  switch strings.ToLower(args) {
+  case "on":
+    SetMouseCapture(true)
+  case "off":
+    SetMouseCapture(false)
+  case "":
+    SetMouseCapture(!MouseCapture)
+  default:
+    LocalMessage("Usage: /mouse [on|off]")
+    return
+  }
+  if MouseCapture {
+    LocalMessage("Mouse capture is on; drag to select and copy text.")
+  } else {
+    LocalMessage("Mouse capture is off; the terminal's own selection works.")
+  }
+}
+
+// Returns the position of the Cell drawn at column x of row y of the
+// terminal (or just after the end of the row, if x is past it). Returns
+// false if there's no text there.
+//
+func CellAt(x, y int) (TextPos, bool) {
+  if x >= SbackW || y < SbackY || y - SbackY >= len(RowMap) {
+    return TextPos{}, false
+  }
+  rp := RowMap[y - SbackY]
+  if rp.Line < FirstLine() || rp.Line >= NumLines() {
+    return TextPos{}, false
+  }
+  l := GetLine(rp.Line)
+  if rp.Row >= LineRows(l) - MarkerRows(l) {
+    return TextPos{}, false
+  }
+  col := TextX
+  if rp.Row > 0 {
+    col = col + l.Indent
+  }
+  if l.Pre {
+    col = col - HScroll
+  }
+  for c := l.Starts[rp.Row]; c < l.Ends[rp.Row]; c++ {
+    col = col + RuneCols(l.C[c].Ch)
+    if x < col {
+      return TextPos{ rp.Line, c }, true
+    }
+  }
+  return TextPos{ rp.Line, l.Ends[rp.Row] }, true
+}
+
+// Returns the ends of the selection, in order.
+//
+func SelectionRange() (TextPos, TextPos) {
+  if SelHead.Before(SelAnchor) {
+    return SelHead, SelAnchor
+  }
+  return SelAnchor, SelHead
+}
+
+// Returns the selected text, with a newline between Lines.
+//
+func SelectionText() string {
+  a, b := SelectionRange()
+  var sb strings.Builder
+  for lidx := a.Line; lidx <= b.Line && lidx < NumLines(); lidx++ {
+    if lidx < FirstLine() {
+      continue
+    }
+    l := GetLine(lidx)
+    start, end := 0, len(l.C)
+    if lidx == a.Line && a.Cell < end {
+      start = a.Cell
+    }
+    if lidx == b.Line && b.Cell + 1 < end {
+      end = b.Cell + 1
+    }
+    for _, c := range l.C[start:end] {
+      sb.WriteRune(c.Ch)
+    }
+    if lidx < b.Line {
+      sb.WriteByte('\n')
+    }
+  }
+  return sb.String()
+}
+
+// Put text on the system clipboard with an OSC 52 escape sequence (which
+// the terminal may or may not support or allow).
+//
+func CopyToClipboard(text string) {
+  enc := base64.StdEncoding.EncodeToString([]byte(text))
+  fmt.Fprintf(os.Stdout, "\x1b]52;c;%s\x07", enc)
+}
+
+// Forget the selection (if there is one) and redraw.
+//
+func ClearSelection() {
+  if HaveSelection || Selecting {
+    HaveSelection, Selecting = false, false
+    DrawScrollback()
+  }
+}
+
+// Returns the given Line (with global index lidx) as it should be drawn: if
+// any of it is selected, a copy with the selection in reverse video.
+//
+func SelectionHighlight(lidx int, l *Line) *Line {
+  if !HaveSelection {
+    return l
+  }
+  a, b := SelectionRange()
+  if lidx < a.Line || lidx > b.Line {
+    return l
+  }
+  start, end := 0, len(l.C)
+  if lidx == a.Line {
+    start = a.Cell
+  }
+  if lidx == b.Line && b.Cell + 1 < end {
+    end = b.Cell + 1
+  }
+  hl := *l
+  hl.C = make([]Cell, len(l.C))
+  copy(hl.C, l.C)
+  for c := start; c < end; c++ {
+    hl.C[c].Fg = hl.C[c].Fg ^ termbox.AttrReverse
+    hl.C[c].Bg = hl.C[c].Bg ^ termbox.AttrReverse
+  }
+  return &hl
+}
+
+// Handle a mouse event: the wheel scrolls the game window; dragging with
+// the left button selects text, which is sent to the clipboard when the
+// button is released.
+//
+func HandleMouse(e termbox.Event) {
+  switch e.Key {
+  case termbox.MouseWheelUp:
+    if Chat.Contains(e.MouseX, e.MouseY) {
+      Chat.Scroll(-MouseWheelRows)
+    } else {
+      ScrollBackwardRows(MouseWheelRows)
+    }
+  case termbox.MouseWheelDown:
+    if Chat.Contains(e.MouseX, e.MouseY) {
+      Chat.Scroll(MouseWheelRows)
+    } else {
+      ScrollForwardRows(MouseWheelRows)
+    }
+  case termbox.MouseLeft:
+    if e.Mod & termbox.ModMotion == 0 && Splitting() && e.MouseY == SplitY() {
+      DraggingSplit = true
+      return
+    }
+    if DraggingSplit {
+      SplitRows = FootY - 1 - e.MouseY
+      if SplitRows > MaxSplitLiveRows() {
+        SplitRows = MaxSplitLiveRows()
+      }
+      if SplitRows < 1 {
+        SplitRows = 1
+      }
+      DrawScrollback()
+      return
+    }
+    if e.Mod & termbox.ModMotion == 0 {
+      HaveSelection = false
+      SelAnchor, Selecting = CellAt(e.MouseX, e.MouseY)
+      SelHead = SelAnchor
+      DrawScrollback()
+      return
+    }
+    if !Selecting {
+      return
+    }
+    // Dragging off the top or bottom of the game window scrolls it.
+    y := e.MouseY
+    if y < SbackY {
+      ScrollBackwardRows(1)
+      y = SbackY
+    } else if y >= FootY {
+      ScrollForwardRows(1)
+      y = FootY - 1
+    }
+    if pos, ok := CellAt(e.MouseX, y); ok {
+      SelHead = pos
+      HaveSelection = SelHead != SelAnchor
+    }
+    DrawScrollback()
+  case termbox.MouseRelease:
+    DraggingSplit = false
+    if Selecting {
+      Selecting = false
+      if HaveSelection {
+        text := SelectionText()
+        CopyToClipboard(text)
+        CopiedChars = utf8.RuneCountInString(text)
+      }
+      UpdateFootLine()
+    }
+  }
+}
+
+// Local commands are handled by the client instead of being sent to the
+// game. They are typed like game commands, but start with LocalCmdPrefix.
+// Each is passed whatever follows its name (with surrounding whitespace
+// trimmed).
+//
+var LocalCmdPrefix = "/"
+var LocalCmds = map[string]func(string){
+  "theme":  ThemeCmd,
+  "mouse":  MouseCmd,
+  "log":    LogCmd,
+  "export": ExportCmd,
+  "view":   ViewCmd,
+}
+
+// Add a line of client (rather than game) messaging to the game window.
+// Unless the split game window will show it anyway, jump to the newest text
+// so it can be seen.
+//
+func LocalMessage(text string) {
+  AddLine(NewLine(text, SysFg, SysBg))
+  if !Splitting() {
+    ViewLine = -1
+  }
+  DrawScrollback()
+}
+
+// If cmd is a local command, run it and return true; otherwise return false
+// (and it should be sent to the game). Commands that just happen to start
+// with LocalCmdPrefix but don't name a local command go to the game.
+//
+func DoLocalCommand(cmd string) bool {
+  if !strings.HasPrefix(cmd, LocalCmdPrefix) {
+    return false
+  }
+  words := strings.SplitN(strings.TrimPrefix(cmd, LocalCmdPrefix), " ", 2)
+  f, ok := LocalCmds[strings.ToLower(words[0])]
+  if !ok {
+    return false
+  }
+  var args string
+  if len(words) > 1 {
+    args = strings.TrimSpace(words[1])
+  }
+  log.Println("DoLocalCommand():", words[0], args)
+  f(args)
+  return true
+}
+
+// "/theme name" switches to the named theme; "/theme" alone lists the
+// available themes.
+//
+func ThemeCmd(args string) {
+  if args == "" {
+    names := make([]string, 0, 0)
+    files, _ := filepath.Glob(filepath.Join(ThemeDir, "*.theme"))
+    for _, f := range files {
+      names = append(names, strings.TrimSuffix(filepath.Base(f), ".theme"))
+    }
+    cur := Theme
+    if cur == "" {
+      cur = "(built-in)"
+    }
+    LocalMessage(fmt.Sprintf("Current theme: %s; available themes: %s", cur,
+                             strings.Join(names, ", ")))
+    return
+  }
+  if err := SwitchTheme(args); err != nil {
+    LocalMessage(fmt.Sprintf("Error switching theme: %s", err))
+  } else {
+    LocalMessage(fmt.Sprintf("Switched to theme %q.", args))
+  }
+}
+
+// Send the current command to the game (or run it, if it's a local
+// command). Add it to the history if it's long enough, and clear the input
+// line. Redraw the input line.
+//
+func SendCommand() {
+  log.Println("SendCommand():")
+  if len(Input) > 0 {
+    if !DoLocalCommand(string(Input)) {
+      e := Env{ Type: "cmd", Text: string(Input) }
+      ncdr.Encode(e)
+      log.Println("    sent:", e)
+    }
+    if len(Input) >= MinCmdLen {
+      if len(cmdHist) == 0 {
+        cmdHist = append(cmdHist, string(Input))
+      } else {
+        cmd_str := string(Input)
+        if cmd_str != cmdHist[len(cmdHist)-1] {
+          cmdHist = append(cmdHist, cmd_str)
+        }
+      }
+    }
+    
+    if len(cmdHist) >= MaxCmdHistSize {
+      new_hist := make([]string, 0, MaxCmdHistSize)
+      new_hist = append(new_hist, cmdHist[len(cmdHist)-MinCmdHistSize:]...)
+      cmdHist = new_hist
+    }
+    
+    cmdHistPtr = len(cmdHist)
+    Input = make([]rune, 0, 0)
+    IP = 0
+    DrawInput()
+  }
+}
+
+// This is meant to be run as a goroutine, listening for termbox.Events
+// and queuing them to be handled.
+//
+func ListenForEvents() {
+  for {
+    EventChan <- termbox.PollEvent()
+  }
+}
+
+// Dispatch handling for queued termbox.Events. These include key (adding
+// characters to or editing the current command, scrolling the history window)
+// and resize events.
+//
+func HandleEvent(e termbox.Event) {
+  switch e.Type {
+  
+  case termbox.EventKey:
+  
+    if e.Ch != 0 {
+      InsertInInput(e.Ch)
+      if DEBUG {
+        FootLine = NewLine(fmt.Sprintf("Ch: %d, Mod: %d", e.Ch, e.Mod),
+                           HeadTailFg, HeadTailBg)
+      }
+    } else {
+      switch e.Key {
+      case termbox.KeySpace:
+        InsertInInput(' ')
+      case termbox.KeyBackspace, 127:
+        InputBackspace()
+      case termbox.KeyDelete:
+        InputDelete()
+      case termbox.KeyArrowLeft:
+        MoveInputIp(-1)
+      case termbox.KeyArrowRight:
+        MoveInputIp(1)
+      case termbox.KeyHome:
+        MoveInputIp(-len(Input))
+      case termbox.KeyEnd:
+        MoveInputIp(len(Input))
+      case 13:    // return
+        if SearchPrompting {
+          EndSearchPrompt(true)
+        } else {
+          SendCommand()
+        }
+      case termbox.KeyArrowUp:
+        if !SearchPrompting {
+          CmdHistBack()
+        }
+      case termbox.KeyArrowDown:
+        if !SearchPrompting {
+          CmdHistForward()
+        }
+      case termbox.KeyCtrlY:
+        ScrollBackwardRows(1)
+      case termbox.KeyCtrlE:
+        ScrollForwardRows(1)
+      case termbox.KeyCtrlU:
+        ScrollBackwardRows(HalfScreen())
+      case termbox.KeyCtrlD:
+        ScrollForwardRows(HalfScreen())
+      case termbox.KeyCtrlF:
+        StartSearchPrompt()
+      case termbox.KeyCtrlP:
+        StepSearch(-1)
+      case termbox.KeyCtrlN:
+        StepSearch(1)
+      case termbox.KeyCtrlG:
+        // Back out of whatever's going on. (Esc can't be used for this:
+        // in InputAlt mode, termbox only reports it as the start of an
+        // Alt+key.)
+        if SearchPrompting {
+          EndSearchPrompt(false)
+        } else if HaveSelection {
+          ClearSelection()
+        } else if SearchRe != nil {
+          EndSearch()
+        } else {
+          ScrollToFront()
+        }
+      case termbox.KeyPgup:
+        ScrollBackward()
+      case termbox.KeyPgdn:
+        ScrollForward()
+      case termbox.KeyF4:
+        Chat.Scroll(-(Chat.H - ScrollbackOverlap))
+      case termbox.KeyF5:
+        Chat.Scroll(Chat.H - ScrollbackOverlap)
+      case termbox.KeyF2:
+        ScrollHorizontally(-HScrollStep)
+      case termbox.KeyF3:
+        ScrollHorizontally(HScrollStep)
+      case termbox.KeyF11:
+        ScrollToBack()
+      case termbox.KeyF12:
+        ScrollToFront()
+      case termbox.KeyF9:
+        ToggleGagged()
+      case termbox.KeyF7:
+        ToggleTimestamps()
+      case termbox.KeyF6:
+        CycleView()
+      case termbox.KeyF8:
+        JumpToMarker()
+      }
+      if DEBUG {
+        FootLine = NewLine(fmt.Sprintf("Key: %d, Mod: %d", e.Key, e.Mod),
+                           HeadTailFg, HeadTailBg)
+      }
+    }
+    
+    if DEBUG {
+      DrawFootline()
+    }
+    
+  case termbox.EventMouse:
+    HandleMouse(e)
+    
+  case termbox.EventInterrupt:
+    DrawHeadLine()
+    
+  case termbox.EventResize:
+    log.Println("Rec'd EventResize: (", e.Width, e.Height, ")")
+    Redimension(e.Width, e.Height)
+    Recalculate()
+    RedrawAll()
+    termbox.Sync()
+  }
+
+  termbox.Flush()
+}
+
+// Panic on error with an appropriate message. Certain errors just shouldn't
+// be recoverable.
+//
+func die(err error, fmtstr string, args ...interface{}) {
+  if err != nil {
+    fmt.Printf(fmtstr, args...)
+    panic(err)
+  }
+}
+
+// An Env represents an envelope for a message sent to or received from the
+// game.
+//
+type Env struct {
+  Type string
+  Text string
+}
+
+// Lines of "txt" Envs consisting of just these mark the beginning and end
+// of preformatted text. (Text can also be sent preformatted in a "pre" Env.)
+var PreStart = "{pre}"
+var PreEnd   = "{/pre}"
+// Whether the last "txt" Env left off between a PreStart line and a PreEnd
+// line, so that preformatted text can be split across several Envs.
+var InPre = false
+
+// Holds queued Envs for processing.
+var EnvChan = make(chan Env, 256)
+// For sending and receiving data from the game.
+var ncdr *json.Encoder
+var dcdr *json.Decoder
+
+// This is meant to be run as a goroutine. It listens for messages sent from
+// the game and queues them for handling.
+//
+func ListenForEnvelopes(d *json.Decoder) {
+  var e Env
+  var err error
+  
+  for {
+    err = d.Decode(&e)
+    if err == nil {
+      log.Println("ListenForEnvelopes() rec'd Env:", e)
+      EnvChan <- e
+    } else if err == io.EOF {
+      log.Println("ListenForEnvelopes(): EOF rec'd; quitting")
+      EnvChan <- Env{ Type: "logout", Text: "connection broken" }
+      return
+    } else {
+      log.Println("Error decoding JSON:", err)
+    }
+  }
+}
+
+// A RawRule is a single KEY=value line read from the rules file, before it
+// has been interpreted as whatever sort of rule it describes.
+//
+type RawRule struct {
+  Key   string
+  Val   string
+  LineN int
+}
+
+// ReadRules() reads the rules file. It uses the same KEY=value format as the
+// configuration file, but unlike the configuration file, a key can appear any
+// number of times; each occurrence becomes its own RawRule, in order. Blank
+// lines and lines starting with '#' are ignored. A line with no '=' is
+// returned as a RawRule with an empty Key so it can be reported.
+//
+func ReadRules(fname string) ([]RawRule, error) {
+  f, err := os.Open(fname)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  rules := make([]RawRule, 0, 0)
+  scanner := bufio.NewScanner(f)
+  line_n := 0
+  for scanner.Scan() {
+    line_n++
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" || line[0] == '#' {
+      continue
+    }
+    eq := strings.Index(line, "=")
+    if eq < 0 {
+      rules = append(rules, RawRule{ Key: "", Val: line, LineN: line_n })
+    } else {
+      rules = append(rules, RawRule{
+        Key:   strings.ToLower(strings.TrimSpace(line[:eq])),
+        Val:   strings.TrimSpace(line[eq+1:]),
+        LineN: line_n,
+      })
+    }
+  }
+  return rules, scanner.Err()
+}
+
+// The types of Env that carry text destined for the game window. Rules can
+// be restricted to some subset of these.
+var TextEnvTypes = map[string]bool{ "txt": true, "speech": true, "echo": true,
+                                    "sys": true, "wall": true, "pre": true, }
+
+// SplitRuleTypes() separates an optional "types:" prefix from the value of
+// a rule. The prefix is a comma-separated list of Env types (or "*" for all
+// of them); it is only recognized as such if every item in it is actually an
+// Env type, so a rule like "GAG=OOC: spam" still works as expected. A nil map
+// means the rule applies to every type.
+//
+func SplitRuleTypes(val string) (map[string]bool, string) {
+  colon := strings.Index(val, ":")
+  if colon < 0 {
+    return nil, val
+  }
+  prefix := strings.TrimSpace(val[:colon])
+  if prefix == "*" {
+    return nil, val[colon+1:]
+  }
+  types := make(map[string]bool)
+  for _, t := range strings.Split(prefix, ",") {
+    t = strings.ToLower(strings.TrimSpace(t))
+    if !TextEnvTypes[t] {
+      return nil, val
+    }
+    types[t] = true
+  }
+  return types, val[colon+1:]
+}
+
+// A Gag causes lines matching its Re (and arriving in an Env whose type is
+// in Types, if Types is non-nil) to be dropped instead of being added to the
+// game window.
+//
+type Gag struct {
+  Types map[string]bool
+  Re    *regexp.Regexp
+}
+
+// A GaggedLine remembers the text of a line that was gagged, and the type
+// of Env it arrived in.
+//
+type GaggedLine struct {
+  Type string
+  Text string
+}
+
+// All configured Gags.
+var Gags = make([]*Gag, 0, 0)
+// Total number of lines gagged this session. Shown in the FootLine.
+var GaggedCount int = 0
+// The most recently gagged lines (up to about GagMemory of them).
+var GaggedLines = make([]GaggedLine, 0, 0)
+// When true, gagged lines are shown (in GagFg) instead of dropped.
+var RevealGagged = false
+
+// AddGag() parses the value of a GAG rule ("[types:]regexp") and adds the
+// resulting Gag.
+//
+func AddGag(val string) error {
+  types, pattern := SplitRuleTypes(val)
+  re, err := regexp.Compile(pattern)
+  if err != nil {
+    return err
+  }
+  Gags = append(Gags, &Gag{ Types: types, Re: re })
+  return nil
+}
+
+// A Sub rewrites text matching its Re (in Lines arriving in an Env whose
+// type is in Types, if Types is non-nil), replacing it with Repl.
+//
+type Sub struct {
+  Types map[string]bool
+  Re    *regexp.Regexp
+  Repl  string
+}
+
+// All configured Subs, in the order they are applied.
+var Subs = make([]*Sub, 0, 0)
+
+// AddSub() parses the value of a SUB rule ("[types:]regexp => replacement")
+// and adds the resulting Sub.
+//
+func AddSub(val string) error {
+  types, rest := SplitRuleTypes(val)
+  arrow := strings.Index(rest, "=>")
+  if arrow < 0 {
+    return fmt.Errorf("expected regexp => replacement")
+  }
+  re, err := regexp.Compile(strings.TrimSpace(rest[:arrow]))
+  if err != nil {
+    return err
+  }
+  repl := strings.TrimSpace(rest[arrow+2:])
+  Subs = append(Subs, &Sub{ Types: types, Re: re, Repl: repl })
+  return nil
+}
+
+// AddColorAlias() parses the value of a COLOR rule ("name => color") and
+// adds the alias, so the server's "{c:name}" markup shows up in whatever
+// color the user wants.
+//
+func AddColorAlias(val string) error {
+  arrow := strings.Index(val, "=>")
+  if arrow < 0 {
+    return fmt.Errorf("expected name => color")
+  }
+  name := strings.ToLower(strings.TrimSpace(val[:arrow]))
+  desc := strings.TrimSpace(val[arrow+2:])
+  if _, err := ParseColor(desc); err != nil {
+    return err
+  }
+  ColorAliases[name] = desc
+  return nil
+}
+
+// AddSpeakerColor() parses the value of a SPEAKER rule ("name => color"),
+// so that the named character's speech is always shown in that color.
+//
+func AddSpeakerColor(val string) error {
+  arrow := strings.Index(val, "=>")
+  if arrow < 0 {
+    return fmt.Errorf("expected name => color")
+  }
+  c, err := ParseColor(strings.TrimSpace(val[arrow+2:]))
+  if err != nil {
+    return err
+  }
+  SpeakerOverrides[strings.ToLower(strings.TrimSpace(val[:arrow]))] = c
+  return nil
+}
+
+// An Alert gets your attention (by ringing the terminal bell, asking the
+// terminal for a desktop notification, and/or flashing the Head Line) when
+// a Line matching its Re arrives in an Env whose type is in Types (if Types
+// is non-nil). Once it has gone off, it stays quiet for Every.
+//
+type Alert struct {
+  Types  map[string]bool
+  Re     *regexp.Regexp
+  Bell   bool
+  Notify bool
+  Flash  bool
+  Every  time.Duration
+  Last   time.Time
+}
+
+// All configured Alerts (from ALERT rules, plus the one for CharName).
+var Alerts = make([]*Alert, 0, 0)
+// The Head Line is drawn in reverse video until this time.
+var FlashUntil time.Time
+
+// Sets the actions of an Alert from a list of them ("bell", "notify",
+// "flash"; separated by commas or spaces), optionally followed by "every N"
+// (to stay quiet for N seconds after going off, instead of AlertInterval).
+//
+func (a *Alert) SetActions(spec string) error {
+  a.Every = time.Duration(AlertInterval) * time.Second
+  words := strings.FieldsFunc(strings.ToLower(spec), func(r rune) bool {
+    return r == ',' || r == ' ' || r == '\t'
+  })
+  for n := 0; n < len(words); n++ {
+    switch words[n] {
+    case "bell":
+      a.Bell = true
+    case "notify":
+      a.Notify = true
+    case "flash":
+      a.Flash = true
+    case "every":
+      n++
+      if n == len(words) {
+        return fmt.Errorf("expected a number of seconds after \"every\"")
+      }
+      secs, err := strconv.Atoi(words[n])
+      if err != nil || secs < 0 {
+        return fmt.Errorf("bad number of seconds %q", words[n])
+      }
+      a.Every = time.Duration(secs) * time.Second
+    default:
+      return fmt.Errorf("unknown alert action %q", words[n])
+    }
+  }
+  if !(a.Bell || a.Notify || a.Flash) {
+    return fmt.Errorf("expected bell, notify, and/or flash")
+  }
+  return nil
+}
+
+// AddAlert() parses the value of an ALERT rule ("[types:]regexp => actions")
+// and adds the resulting Alert.
+//
+func AddAlert(val string) error {
+  types, rest := SplitRuleTypes(val)
+  arrow := strings.Index(rest, "=>")
+  if arrow < 0 {
+    return fmt.Errorf("expected regexp => actions")
+  }
+  re, err := regexp.Compile(strings.TrimSpace(rest[:arrow]))
+  if err != nil {
+    return err
+  }
+  a := &Alert{ Types: types, Re: re }
+  if err := a.SetActions(rest[arrow+2:]); err != nil {
+    return err
+  }
+  Alerts = append(Alerts, a)
+  return nil
+}
+
+// Adds an Alert (doing whatever AlertOnName says) for the given character
+// name appearing as a whole word in anything but system messages.
+//
+func AddNameAlert(name string) {
+  if name == "" || strings.TrimSpace(AlertOnName) == "" {
+    return
+  }
+  a := &Alert{
+    Types: map[string]bool{ "txt": true, "speech": true, "wall": true, "pre": true },
+    Re:    regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(name) + `\b`),
+  }
+  if err := a.SetActions(AlertOnName); err != nil {
+    log.Println("AddNameAlert(", name, "):", err)
+    return
+  }
+  Alerts = append(Alerts, a)
+}
+
+// Sets off every applicable Alert that matches a Line arriving in an Env of
+// type etype (unless it went off too recently). Your own echoed commands
+// never set off alerts.
+//
+func CheckAlerts(etype string, l *Line) {
+  if etype == "echo" || len(Alerts) == 0 {
+    return
+  }
+  text := l.String()
+  now := time.Now()
+  var bell, notify, flash bool
+  for _, a := range Alerts {
+    if a.Types != nil && !a.Types[etype] {
+      continue
+    }
+    if !a.Re.MatchString(text) || now.Sub(a.Last) < a.Every {
+      continue
+    }
+    log.Println("CheckAlerts(", etype, text, "): alert", a.Re)
+    a.Last = now
+    bell, notify, flash = bell || a.Bell, notify || a.Notify, flash || a.Flash
+  }
+  if bell {
+    fmt.Fprint(os.Stdout, "\a")
+  }
+  if notify {
+    Notify(text)
+  }
+  if flash {
+    FlashHeadLine()
+  }
+}
+
+// Ask the terminal to pop up a desktop notification with the given text,
+// using the OSC 9 and/or OSC 777 escape sequences (see NotifyEscape).
+// Terminals that don't understand them should ignore them.
+//
+func Notify(text string) {
+  text = strings.Map(func(r rune) rune {
+    if r < ' ' || r == 0x7f {
+      return -1
+    }
+    return r
+  }, strings.TrimSpace(text))
+  if len(text) > 200 {
+    text = text[:200]
+    for !utf8.ValidString(text) {
+      text = text[:len(text)-1]
+    }
+  }
+  title := "dta5"
+  if CharName != "" {
+    title = "dta5: " + strings.Replace(CharName, ";", "", -1)
+  }
+  switch NotifyEscape {
+  case "9":
+    fmt.Fprintf(os.Stdout, "\x1b]9;%s\x07", text)
+  case "both":
+    fmt.Fprintf(os.Stdout, "\x1b]9;%s\x07", text)
+    fallthrough
+  default:
+    fmt.Fprintf(os.Stdout, "\x1b]777;notify;%s;%s\x07", title, text)
+  }
+}
+
+// Draw the Head Line in reverse video for AlertFlashMs milliseconds. An
+// interrupt Event is queued for when it's done, so HandleEvent() can put it
+// back.
+//
+func FlashHeadLine() {
+  d := time.Duration(AlertFlashMs) * time.Millisecond
+  FlashUntil = time.Now().Add(d)
+  DrawHeadLine()
+  time.AfterFunc(d, func() {
+    EventChan <- termbox.Event{ Type: termbox.EventInterrupt }
+  })
+}
+
+// Apply every applicable Sub, in order, to a Line that arrived in an Env of
+// type etype.
+//
+func ApplySubs(etype string, l *Line) {
+  for _, s := range Subs {
+    if s.Types == nil || s.Types[etype] {
+      l.Substitute(s.Re, s.Repl)
+    }
+  }
+}
+
+// Adds a Line that arrived in an Env of type etype to the game window, after
+// rewriting it according to any Subs, and logs it (and counts it as unread,
+// if the game window is scrolled back). Speech (and maybe walls) go to the
+// chat pane, too, or instead (see ChatInMain).
+//
+func AddEnvLine(etype string, l *Line) {
+  l.Type = etype
+  l.Time = time.Now()
+  ApplySubs(etype, l)
+  LogLine(l)
+  CheckAlerts(etype, l)
+  if etype == "speech" && ScrolledBack() {
+    UnreadSpeech++
+    UpdateTitle()
+  }
+  if ChatWants(etype) {
+    Chat.Add(l.Copy())
+    Chat.Draw()
+    if !ChatInMain && Chat.Shown() {
+      return
+    }
+  }
+  if ScrolledBack() {
+    if UnreadFrom < 0 {
+      UnreadFrom = NumLines()
+    }
+    UnreadLines++
+  }
+  AddLine(l)
 }
 
-// This is meant to be run as a goroutine, listening for termbox.Events
-// and queuing them to be handled.
+// Returns a *Line displaying the given gagged line, for use when gagged
+// lines are being revealed.
 //
-func ListenForEvents() {
-  for {
-    EventChan <- termbox.PollEvent()
+func NewGaggedLine(g GaggedLine) *Line {
+  return NewLine(fmt.Sprintf("[%s] %s", g.Type, g.Text), GagFg, GagBg)
+}
+
+// Gagged() reports whether the given text (with any ANSI escapes already
+// stripped), which arrived in an Env of type etype, matches any Gag.
+// Matching lines are counted and remembered; if gagged lines are currently
+// being revealed, it is added to the game window (marked as gagged) here,
+// and the caller should still not add it.
+//
+func Gagged(etype, text string) bool {
+  var matched bool = false
+  for _, g := range Gags {
+    if (g.Types == nil || g.Types[etype]) && g.Re.MatchString(text) {
+      matched = true
+      break
+    }
+  }
+  if !matched {
+    return false
+  }
+
+  log.Println("Gagged(", etype, text, ")")
+  GaggedCount++
+  if len(GaggedLines) >= 2 * GagMemory {
+    new_gagged := make([]GaggedLine, 0, 2 * GagMemory)
+    new_gagged = append(new_gagged, GaggedLines[len(GaggedLines)-GagMemory:]...)
+    GaggedLines = new_gagged
+  }
+  g := GaggedLine{ Type: etype, Text: text }
+  GaggedLines = append(GaggedLines, g)
+  if RevealGagged {
+    AddLine(NewGaggedLine(g))
   }
+  UpdateFootLine()
+  return true
 }
 
-// Dispatch handling for queued termbox.Events. These include key (adding
-// characters to or editing the current command, scrolling the history window)
-// and resize events.
+// Toggle between dropping gagged lines and revealing them. When revealing
+// is turned on, the most recently gagged lines are added to the game window.
 //
-func HandleEvent(e termbox.Event) {
-  switch e.Type {
-  
-  case termbox.EventKey:
-  
-    if e.Ch != 0 {
-      InsertInInput(e.Ch)
-      if DEBUG {
-        FootLine = NewLine(fmt.Sprintf("Ch: %d, Mod: %d", e.Ch, e.Mod),
-                           HeadTailFg, HeadTailBg)
-      }
-    } else {
-      switch e.Key {
-      case termbox.KeySpace:
-        InsertInInput(' ')
-      case termbox.KeyBackspace, 127:
-        InputBackspace()
-      case termbox.KeyDelete:
-        InputDelete()
-      case termbox.KeyArrowLeft:
-        MoveInputIp(-1)
-      case termbox.KeyArrowRight:
-        MoveInputIp(1)
-      case termbox.KeyHome:
-        MoveInputIp(-len(Input))
-      case termbox.KeyEnd:
-        MoveInputIp(len(Input))
-      case 13:    // return
-        SendCommand()
-      case termbox.KeyArrowUp:
-        CmdHistBack()
-      case termbox.KeyArrowDown:
-        CmdHistForward()
-      case termbox.KeyPgup:
-        ScrollBackward()
-      case termbox.KeyPgdn:
-        ScrollForward()
-      case termbox.KeyF12:
-        ScrollToFront()
-      }
-      if DEBUG {
-        FootLine = NewLine(fmt.Sprintf("Key: %d, Mod: %d", e.Key, e.Mod),
-                           HeadTailFg, HeadTailBg)
-      }
+func ToggleGagged() {
+  RevealGagged = !RevealGagged
+  if RevealGagged {
+    start := len(GaggedLines) - GagMemory
+    if start < 0 {
+      start = 0
     }
-    
-    if DEBUG {
-      DrawFootline()
+    AddLine(NewLine(fmt.Sprintf("-- %d recently gagged lines --",
+                                len(GaggedLines) - start), GagFg, GagBg))
+    for _, g := range GaggedLines[start:] {
+      AddLine(NewGaggedLine(g))
     }
-    
-  case termbox.EventResize:
-    log.Println("Rec'd EventResize: (", e.Width, e.Height, ")")
-    termbox.Clear(DefaultFg, DefaultBg)
-    Redimension(e.Width, e.Height)
-    Recalculate()
-    DrawHeadLine()
-    DrawScrollback()
-    DrawFootline()
-    DrawInput()
-    termbox.Sync()
+    AddLine(NewLine("-- gagged lines will be shown until toggled off --",
+                    GagFg, GagBg))
+  } else {
+    AddLine(NewLine("-- gagging resumed --", GagFg, GagBg))
   }
+  ViewLine = -1
+  DrawScrollback()
+  UpdateFootLine()
+}
 
-  termbox.Flush()
+// Read the rules file and set up whatever rules it describes. A missing
+// rules file just means no rules; problems with individual rules are
+// reported and the offending rules skipped.
+//
+func LoadRules() {
+  rules, err := ReadRules(RulesFile)
+  if err != nil {
+    if !os.IsNotExist(err) {
+      fmt.Printf("Error reading rules file %q: %s\n", RulesFile, err)
+    }
+    return
+  }
+
+  for _, r := range rules {
+    switch r.Key {
+    case "gag":
+      err = AddGag(r.Val)
+    case "sub":
+      err = AddSub(r.Val)
+    case "color":
+      err = AddColorAlias(r.Val)
+    case "speaker":
+      err = AddSpeakerColor(r.Val)
+    case "alert":
+      err = AddAlert(r.Val)
+    case "":
+      err = fmt.Errorf("expected KEY=value")
+    default:
+      err = fmt.Errorf("unknown rule type %q", r.Key)
+    }
+    if err != nil {
+      fmt.Printf("%s line %d: %s\n", RulesFile, r.LineN, err)
+    }
+  }
 }
 
-// Panic on error with an appropriate message. Certain errors just shouldn't
-// be recoverable.
+// Build SpeechRe from SpeechPattern, or, if that's blank, from SpeechVerbs
+// (a comma-separated list; each verb also matches with an "s" on the end),
+// and find which of its groups is the speaker's name.
 //
-func die(err error, fmtstr string, args ...interface{}) {
+func BuildSpeechRe() error {
+  pattern := SpeechPattern
+  if pattern == "" {
+    verbs := make([]string, 0, 0)
+    for _, v := range strings.Split(SpeechVerbs, ",") {
+      v = strings.TrimSpace(v)
+      if v != "" {
+        verbs = append(verbs, regexp.QuoteMeta(v) + "s?")
+      }
+    }
+    pattern = `^(?P<speaker>[^"]+?) (?:` + strings.Join(verbs, "|") + `)\b[^"]*`
+  }
+  re, err := regexp.Compile(pattern)
   if err != nil {
-    fmt.Printf(fmtstr, args...)
-    panic(err)
+    return err
   }
+  SpeechRe = re
+  SpeakerGroup = -1
+  for n, name := range re.SubexpNames() {
+    if name == "speaker" {
+      SpeakerGroup = n
+    }
+  }
+  return nil
 }
 
-// An Env represents an envelope for a message sent to or received from the
-// game.
+// Parse SpeakerPalette into SpeakerColors.
 //
-type Env struct {
-  Type string
-  Text string
+func BuildSpeakerColors() error {
+  SpeakerColors = make([]termbox.Attribute, 0, 0)
+  for _, desc := range strings.Split(SpeakerPalette, ",") {
+    if strings.TrimSpace(desc) == "" {
+      continue
+    }
+    c, err := ParseColor(desc)
+    if err != nil {
+      return err
+    }
+    SpeakerColors = append(SpeakerColors, c)
+  }
+  return nil
 }
 
-// Holds queued Envs for processing.
-var EnvChan = make(chan Env, 256)
-// For sending and receiving data from the game.
-var ncdr *json.Encoder
-var dcdr *json.Decoder
+// Returns the color for the given speaker: their SPEAKER rule color if they
+// have one; otherwise one picked from SpeakerColors based on their name, so
+// that it's the same every time.
+//
+func SpeakerColor(name string) termbox.Attribute {
+  name = strings.ToLower(strings.TrimSpace(name))
+  if c, ok := SpeakerOverrides[name]; ok {
+    return c
+  }
+  if !ColorSpeakers || len(SpeakerColors) == 0 {
+    return SpeechFg
+  }
+  h := fnv.New32a()
+  h.Write([]byte(name))
+  return SpeakerColors[h.Sum32() % uint32(len(SpeakerColors))]
+}
 
-// This is meant to be run as a goroutine. It listens for messages sent from
-// the game and queues them for handling.
+// Color the "So-and-so says," part of a line of speech in SpeechFg, and the
+// speaker's name in their own color. Returns the speaker's name ("" if
+// the line doesn't match SpeechRe).
 //
-func ListenForEnvelopes(d *json.Decoder) {
-  var e Env
-  var err error
-  
-  for {
-    err = d.Decode(&e)
-    if err == nil {
-      log.Println("ListenForEnvelopes() rec'd Env:", e)
-      EnvChan <- e
-    } else if err == io.EOF {
-      log.Println("ListenForEnvelopes(): EOF rec'd; quitting")
-      EnvChan <- Env{ Type: "logout", Text: "connection broken" }
-      return
-    } else {
-      log.Println("Error decoding JSON:", err)
-    }
+func ColorSpeech(l *Line) string {
+  text := l.String()
+  idxs := SpeechRe.FindStringSubmatchIndex(text)
+  if idxs == nil {
+    return ""
   }
+  l.Colorize(0, utf8.RuneCountInString(text[:idxs[1]]),
+             DefaultFg, DefaultBg, SpeechFg, SpeechBg)
+  if SpeakerGroup < 0 || idxs[2*SpeakerGroup] < 0 {
+    return ""
+  }
+  start, end := idxs[2*SpeakerGroup], idxs[2*SpeakerGroup+1]
+  name := text[start:end]
+  l.Colorize(utf8.RuneCountInString(text[:start]), utf8.RuneCountInString(text[:end]),
+             SpeechFg, SpeechBg, SpeakerColor(name), SpeechBg)
+  return name
 }
 
 // Handle queued messages from the game, adding text to the game window,
@@ -801,33 +4423,76 @@ func ProcessEnvelope(e Env) {
   switch e.Type {
   
   case "txt":
+    // Lines between a "{pre}" line and a "{/pre}" line are preformatted
+    // (and markup in them isn't interpreted).
+    sgr := NewMarkupState(DefaultFg, DefaultBg)
+    sgr.Markup = !InPre
+    for _, line := range strings.Split(e.Text, "\n") {
+      if trimmed := strings.TrimSpace(line); trimmed == PreStart {
+        InPre = true
+        sgr.Markup = false
+        continue
+      } else if trimmed == PreEnd {
+        InPre = false
+        sgr.Markup = true
+        continue
+      }
+      new_line := sgr.NewLine(line)
+      new_line.Pre = InPre
+      if !Gagged(e.Type, new_line.String()) {
+        AddEnvLine(e.Type, new_line)
+      }
+    }
+    DrawScrollback()
+  case "pre":
+    sgr := NewSGRState(DefaultFg, DefaultBg)
     for _, line := range strings.Split(e.Text, "\n") {
-      AddDefaultLine(line)
+      new_line := sgr.NewLine(line)
+      new_line.Pre = true
+      if !Gagged(e.Type, new_line.String()) {
+        AddEnvLine(e.Type, new_line)
+      }
     }
     DrawScrollback()
   case "headline":
-    HeadLine = NewLine(e.Text, HeadTailFg, HeadTailBg)
+    HeadLine = NewMarkupState(HeadTailFg, HeadTailBg).NewLine(e.Text)
     DrawHeadLine()
+    UpdateTitle()
   case "echo":
+    if Gagged(e.Type, StripANSI(e.Text)) {
+      DrawScrollback()
+      break
+    }
     if SkipAfterSend {
-      AddDefaultLine(" ")
+      // The blank line isn't game text, so it bypasses AddEnvLine() (and
+      // with it Subs, logging, alerts, and the unread count), but it's
+      // still an "echo" Line, so views that hide echoes hide it too.
+      spacer := NewLine(" ", DefaultFg, DefaultBg)
+      spacer.Type = e.Type
+      AddLine(spacer)
+    }
+    AddEnvLine(e.Type, NewLine(e.Text, EchoFg, EchoBg))
+    if !Splitting() {
+      ViewLine = -1
     }
-    AddLine(NewLine(e.Text, EchoFg, EchoBg))
-    ScrollbackPos = 0
     DrawScrollback()
   case "speech":
-    idxs := SpeechRe.FindStringIndex(e.Text)
-    if idxs == nil {
-      AddDefaultLine(e.Text)
-    } else {
-      new_line := NewLine(e.Text[:idxs[1]], SpeechFg, SpeechBg)
-      new_line.Add(e.Text[idxs[1]:], DefaultFg, DefaultBg)
-      AddLine(new_line)
+    new_line := NewMarkupState(DefaultFg, DefaultBg).NewLine(e.Text)
+    text := new_line.String()
+    if Gagged(e.Type, text) {
+      DrawScrollback()
+      break
     }
+    ColorSpeech(new_line)
+    AddEnvLine(e.Type, new_line)
     DrawScrollback()
   case "wall", "sys":
+    sgr := NewMarkupState(SysFg, SysBg)
     for _, line := range strings.Split(e.Text, "\n") {
-      AddLine(NewLine(line, SysFg, SysBg))
+      new_line := sgr.NewLine(line)
+      if !Gagged(e.Type, new_line.String()) {
+        AddEnvLine(e.Type, new_line)
+      }
     }
     DrawScrollback()
   case "logout":
@@ -840,6 +4505,347 @@ func ProcessEnvelope(e Env) {
   termbox.Flush()
 }
 
+// A ColorSetting connects a configuration file key to the color variable
+// it sets. Val holds the (unparsed) value read from the configuration file,
+// and Default the variable's built-in value.
+//
+type ColorSetting struct {
+  Key     string
+  Attr    *termbox.Attribute
+  Val     string
+  Default termbox.Attribute
+}
+
+var ColorSettings = []*ColorSetting{
+  { Key: "default_fg",  Attr: &DefaultFg,  },
+  { Key: "default_bg",  Attr: &DefaultBg,  },
+  { Key: "speech_fg",   Attr: &SpeechFg,   },
+  { Key: "speech_bg",   Attr: &SpeechBg,   },
+  { Key: "echo_fg",     Attr: &EchoFg,     },
+  { Key: "echo_bg",     Attr: &EchoBg,     },
+  { Key: "sys_fg",      Attr: &SysFg,      },
+  { Key: "sys_bg",      Attr: &SysBg,      },
+  { Key: "bar_fg",      Attr: &HeadTailFg, },
+  { Key: "bar_bg",      Attr: &HeadTailBg, },
+  { Key: "gag_fg",      Attr: &GagFg,      },
+  { Key: "gag_bg",      Attr: &GagBg,      },
+  { Key: "item_fg",     Attr: &ItemFg,     },
+  { Key: "player_fg",   Attr: &PlayerFg,   },
+  { Key: "time_fg",     Attr: &TimeFg,     },
+  { Key: "input_fg",    Attr: &InputFg,    },
+  { Key: "input_bg",    Attr: &InputBg,    },
+}
+
+// Foreground/background pairs of colors that get applied to text together.
+// When the colors change, text in the game window history drawn with one of
+// these pairs gets redrawn with the pair's new colors.
+var ColorPairs = [][2]*termbox.Attribute{
+  { &DefaultFg,  &DefaultBg  },
+  { &SpeechFg,   &SpeechBg   },
+  { &EchoFg,     &EchoBg     },
+  { &SysFg,      &SysBg      },
+  { &GagFg,      &GagBg      },
+  { &HeadTailFg, &HeadTailBg },
+  { &ItemFg,     &DefaultBg  },
+  { &PlayerFg,   &DefaultBg  },
+}
+
+// Names that can be used for colors, and the attributes that can be combined
+// with them.
+var ColorNames = map[string]termbox.Attribute{
+  "default": termbox.ColorDefault,
+  "black":   termbox.ColorBlack,
+  "red":     termbox.ColorRed,
+  "green":   termbox.ColorGreen,
+  "yellow":  termbox.ColorYellow,
+  "blue":    termbox.ColorBlue,
+  "magenta": termbox.ColorMagenta,
+  "cyan":    termbox.ColorCyan,
+  "white":   termbox.ColorWhite,
+  "gray":    termbox.ColorDarkGray,
+  "grey":    termbox.ColorDarkGray,
+}
+var BrightColorNames = map[string]termbox.Attribute{
+  "black":   termbox.ColorDarkGray,
+  "red":     termbox.ColorLightRed,
+  "green":   termbox.ColorLightGreen,
+  "yellow":  termbox.ColorLightYellow,
+  "blue":    termbox.ColorLightBlue,
+  "magenta": termbox.ColorLightMagenta,
+  "cyan":    termbox.ColorLightCyan,
+  "white":   termbox.ColorLightGray,
+}
+var AttrNames = map[string]termbox.Attribute{
+  "bold":      termbox.AttrBold,
+  "underline": termbox.AttrUnderline,
+  "reverse":   termbox.AttrReverse,
+}
+
+// PaletteRGB() returns the (standard xterm) red, green, and blue values of
+// the nth color of the 256-color palette.
+//
+func PaletteRGB(n int) (int, int, int) {
+  var basic = [16][3]int{
+    {0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+    {0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+    {127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+    {92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+  }
+  var levels = [6]int{ 0, 95, 135, 175, 215, 255 }
+  
+  if n < 16 {
+    return basic[n][0], basic[n][1], basic[n][2]
+  } else if n < 232 {
+    n = n - 16
+    return levels[n/36], levels[(n/6)%6], levels[n%6]
+  } else {
+    g := 8 + 10 * (n - 232)
+    return g, g, g
+  }
+}
+
+// NearestPaletteColor() returns the index of the color in the given range
+// of the 256-color palette closest to the given red, green, and blue values.
+//
+func NearestPaletteColor(r, g, b, from, to int) int {
+  best, best_d := from, -1
+  for n := from; n < to; n++ {
+    pr, pg, pb := PaletteRGB(n)
+    d := (pr-r)*(pr-r) + (pg-g)*(pg-g) + (pb-b)*(pb-b)
+    if best_d < 0 || d < best_d {
+      best, best_d = n, d
+    }
+  }
+  return best
+}
+
+// Returns the termbox.Attribute for the nth color of the 256-color palette,
+// approximated with the closest of the first 16 if we aren't in 256-color
+// mode.
+//
+func PaletteAttr(n int) termbox.Attribute {
+  if n < 0 || n > 255 {
+    return termbox.ColorDefault
+  }
+  if n >= 16 && !Use256 {
+    r, g, b := PaletteRGB(n)
+    n = NearestPaletteColor(r, g, b, 0, 16)
+  }
+  return termbox.Attribute(n + 1)
+}
+
+// Returns the termbox.Attribute for the palette color closest to the given
+// red, green, and blue values. (In 256-color mode, the first 16 colors are
+// skipped, because their actual values depend on the terminal.)
+//
+func RGBAttr(r, g, b int) termbox.Attribute {
+  if Use256 {
+    return termbox.Attribute(NearestPaletteColor(r, g, b, 16, 256) + 1)
+  }
+  return termbox.Attribute(NearestPaletteColor(r, g, b, 0, 16) + 1)
+}
+
+// ParseColor() turns a color description from the configuration file into
+// a termbox.Attribute. A description is a color, optionally preceded by
+// "bright" (or "light"), and any number of attributes ("bold", "underline",
+// "reverse"), separated by spaces, commas, or '+'s. A color can be a name, a
+// number from the 256-color palette, or a hex "#rrggbb" value; in 16-color
+// mode, the latter two are approximated with the closest of the first 16
+// colors.
+//
+func ParseColor(desc string) (termbox.Attribute, error) {
+  var color termbox.Attribute = termbox.ColorDefault
+  var attrs termbox.Attribute = 0
+  var bright bool = false
+  
+  words := strings.FieldsFunc(strings.ToLower(desc), func(r rune) bool {
+    return r == ' ' || r == '\t' || r == ',' || r == '+'
+  })
+  for _, w := range words {
+    if a, ok := AttrNames[w]; ok {
+      attrs = attrs | a
+    } else if w == "bright" || w == "light" {
+      bright = true
+    } else if c, ok := ColorNames[w]; ok {
+      if bright {
+        if bc, ok := BrightColorNames[w]; ok {
+          c = bc
+        }
+      }
+      color = c
+    } else if bc, ok := BrightColorNames[strings.TrimPrefix(w, "bright")]; ok &&
+                               strings.HasPrefix(w, "bright") {
+      color = bc
+    } else if bc, ok := BrightColorNames[strings.TrimPrefix(w, "light")]; ok &&
+                               strings.HasPrefix(w, "light") {
+      color = bc
+    } else if w[0] == '#' {
+      hex := w[1:]
+      if len(hex) == 3 {
+        hex = string([]byte{ hex[0], hex[0], hex[1], hex[1], hex[2], hex[2] })
+      }
+      rgb, err := strconv.ParseUint(hex, 16, 32)
+      if err != nil || len(hex) != 6 {
+        return color, fmt.Errorf("bad hex color %q", w)
+      }
+      color = RGBAttr(int(rgb >> 16), int((rgb >> 8) & 0xff), int(rgb & 0xff))
+    } else {
+      n, err := strconv.Atoi(w)
+      if err != nil || n < 0 || n > 255 {
+        return color, fmt.Errorf("unknown color or attribute %q", w)
+      }
+      color = PaletteAttr(n)
+    }
+  }
+  
+  return color | attrs, nil
+}
+
+// Decide whether to use 256-color mode.
+//
+func SetUse256() {
+  switch strings.ToLower(ColorMode) {
+  case "256":
+    Use256 = true
+  case "16":
+    Use256 = false
+  default:
+    Use256 = strings.Contains(os.Getenv("TERM"), "256color") ||
+             os.Getenv("COLORTERM") != ""
+  }
+}
+
+// Put termbox in 256-color output mode if appropriate. Must be called after
+// termbox.Init().
+//
+func SetOutputMode() {
+  if Use256 {
+    termbox.SetOutputMode(termbox.Output256)
+  } else {
+    termbox.SetOutputMode(termbox.OutputNormal)
+  }
+}
+
+// ThemeFile() returns the path of the theme file with the given name. A name
+// that looks like a path is used as-is; otherwise the theme file is the file
+// name + ".theme" in ThemeDir.
+//
+func ThemeFile(name string) string {
+  if strings.ContainsRune(name, '/') || strings.ContainsRune(name, os.PathSeparator) ||
+     strings.HasSuffix(name, ".theme") {
+    return name
+  }
+  return filepath.Join(ThemeDir, name + ".theme")
+}
+
+// ApplyColors() sets every color from, in increasing order of precedence,
+// its built-in default, the named theme (unless name is ""), and the
+// configuration file. Theme files use the same keys as the color settings
+// in the configuration file. If the theme can't be loaded, no colors are
+// changed.
+//
+func ApplyColors(name string) error {
+  theme_colors := make([]termbox.Attribute, len(ColorSettings))
+  for n, cs := range ColorSettings {
+    theme_colors[n] = cs.Default
+  }
+  
+  if name != "" {
+    fname := ThemeFile(name)
+    if _, err := os.Stat(fname); err != nil {
+      return fmt.Errorf("can't find theme %q (%s)", name, fname)
+    }
+    vals := make([]string, len(ColorSettings))
+    dconfig.Reset()
+    for n, cs := range ColorSettings {
+      dconfig.AddString(&vals[n], cs.Key, dconfig.STRIP)
+    }
+    dconfig.Configure([]string{fname}, true)
+    for n, v := range vals {
+      if v != "" {
+        c, err := ParseColor(v)
+        if err != nil {
+          return fmt.Errorf("%s: bad %s setting %q: %s", fname,
+                            strings.ToUpper(ColorSettings[n].Key), v, err)
+        }
+        theme_colors[n] = c
+      }
+    }
+  }
+  
+  for n, cs := range ColorSettings {
+    *cs.Attr = theme_colors[n]
+    if cs.Val != "" {
+      c, err := ParseColor(cs.Val)
+      if err == nil {
+        *cs.Attr = c
+      }
+    }
+  }
+  return nil
+}
+
+// Returns the current colors of each of the ColorPairs.
+//
+func CurrentColorPairs() [][2]termbox.Attribute {
+  pairs := make([][2]termbox.Attribute, 0, len(ColorPairs))
+  for _, p := range ColorPairs {
+    pairs = append(pairs, [2]termbox.Attribute{ *p[0], *p[1] })
+  }
+  return pairs
+}
+
+// After the colors have changed, recolor the Cells of the given Line that
+// were drawn in one of the old ColorPairs with that pair's new colors. Cells
+// with some other foreground (speakers' names, or colors set by the server)
+// but one of the old pairs' backgrounds just get the new background.
+//
+func (l *Line) Recolor(old_pairs, new_pairs [][2]termbox.Attribute) {
+  for n, c := range l.C {
+    var matched bool = false
+    for p, op := range old_pairs {
+      if c.Fg == op[0] && c.Bg == op[1] {
+        l.C[n].Fg, l.C[n].Bg = new_pairs[p][0], new_pairs[p][1]
+        matched = true
+        break
+      }
+    }
+    if !matched {
+      for p, op := range old_pairs {
+        if c.Bg == op[1] {
+          l.C[n].Bg = new_pairs[p][1]
+          break
+        }
+      }
+    }
+  }
+}
+
+// Switch to the named theme, recolor the game window history and Head and
+// Foot lines to match, and redraw everything.
+//
+func SwitchTheme(name string) error {
+  old_pairs := CurrentColorPairs()
+  if err := ApplyColors(name); err != nil {
+    return err
+  }
+  Theme = name
+  new_pairs := CurrentColorPairs()
+  for _, l := range Lines {
+    l.Recolor(old_pairs, new_pairs)
+  }
+  for _, l := range Chat.Lines {
+    l.Recolor(old_pairs, new_pairs)
+  }
+  if ScrollStore != nil {
+    ScrollStore.Recolored()
+  }
+  HeadLine.Recolor(old_pairs, new_pairs)
+  UpdateFootLine()
+  RedrawAll()
+  return nil
+}
+
 // Read the configuration file and set the appropriate variable values.
 //
 func Config() {
@@ -852,22 +4858,113 @@ func Config() {
   dconfig.AddInt(&port,               "port",       dconfig.UNSIGNED)
   dconfig.AddInt(&MinScrollbackLines, "scrollback", dconfig.UNSIGNED)
   dconfig.AddInt(&ScrollbackOverlap,  "scrollback_overlap", dconfig.UNSIGNED)
+  dconfig.AddBool(&SplitView,         "split_view")
+  dconfig.AddString(&ChatPosition,    "chat_pane",   dconfig.STRIP)
+  dconfig.AddInt(&ChatHeight,         "chat_height", dconfig.UNSIGNED)
+  dconfig.AddInt(&ChatWidth,          "chat_width",  dconfig.UNSIGNED)
+  dconfig.AddBool(&ChatWall,          "chat_wall")
+  dconfig.AddBool(&ChatInMain,        "speech_in_main")
+  dconfig.AddString(&AlertOnName,     "alert_on_name",  dconfig.STRIP)
+  dconfig.AddInt(&AlertInterval,      "alert_interval", dconfig.UNSIGNED)
+  dconfig.AddString(&NotifyEscape,    "notify_escape",  dconfig.STRIP)
+  dconfig.AddInt(&AlertFlashMs,       "alert_flash_ms", dconfig.UNSIGNED)
+  dconfig.AddString(&TitleFormat,     "title_format",   dconfig.STRIP)
+  dconfig.AddBool(&Logging,           "log")
+  dconfig.AddString(&GameLogFile,     "log_file",   dconfig.STRIP)
+  dconfig.AddString(&GameLogFormat,   "log_format", dconfig.STRIP)
+  dconfig.AddBool(&GameLogDaily,      "log_daily")
+  dconfig.AddInt(&GameLogMaxKB,       "log_max_kb", dconfig.UNSIGNED)
+  dconfig.AddBool(&GameLogTimestamps, "log_timestamps")
+  dconfig.AddInt(&SplitRows,          "split_rows", dconfig.UNSIGNED)
+  dconfig.AddBool(&StoreScrollback,   "scrollback_store")
+  dconfig.AddString(&ScrollbackDir,   "scrollback_dir", dconfig.STRIP)
+  dconfig.AddBool(&KeepScrollback,    "keep_scrollback")
+  dconfig.AddBool(&PreserveIndent,    "preserve_indent")
+  dconfig.AddInt(&HangingIndent,      "hanging_indent", dconfig.UNSIGNED)
+  dconfig.AddInt(&TabWidth,           "tab_width",      dconfig.UNSIGNED)
+  dconfig.AddInt(&MaxTextWidth,       "max_text_width", dconfig.UNSIGNED)
+  dconfig.AddBool(&CenterText,        "center_text")
+  dconfig.AddBool(&ShowTimestamps,    "timestamps")
+  dconfig.AddString(&TimestampFormat, "timestamp_format", dconfig.STRIP)
+  dconfig.AddBool(&MouseCapture,      "mouse")
+  dconfig.AddInt(&MouseWheelRows,     "mouse_wheel_rows", dconfig.UNSIGNED)
   dconfig.AddBool(&SkipAfterSend,     "extra_line")
   dconfig.AddBool(&ShowNews,          "show_news")
   dconfig.AddInt(&MinCmdLen,          "min_cmd_len", dconfig.UNSIGNED)
   dconfig.AddInt(&MinCmdHistSize,     "cmd_history", dconfig.UNSIGNED)
   dconfig.AddString(&Uname,           "uname",       dconfig.STRIP)
   dconfig.AddString(&Pwd,             "pwd",         dconfig.STRIP)
+  dconfig.AddString(&RulesFile,       "rules_file",  dconfig.STRIP)
+  dconfig.AddInt(&GagMemory,          "gag_memory",  dconfig.UNSIGNED)
+  dconfig.AddString(&ColorMode,       "color_mode",  dconfig.STRIP)
+  dconfig.AddString(&Theme,           "theme",       dconfig.STRIP)
+  dconfig.AddString(&ThemeDir,        "theme_dir",   dconfig.STRIP)
+  dconfig.AddString(&SpeechVerbs,     "speech_verbs",   dconfig.STRIP)
+  dconfig.AddString(&SpeechPattern,   "speech_pattern", dconfig.STRIP)
+  dconfig.AddBool(&ColorSpeakers,     "color_speakers")
+  dconfig.AddString(&SpeakerPalette,  "speaker_colors", dconfig.STRIP)
+  for _, cs := range ColorSettings {
+    cs.Default = *cs.Attr
+    dconfig.AddString(&cs.Val, cs.Key, dconfig.STRIP)
+  }
   dconfig.Configure([]string{cfg_file}, true)
   
   MaxScrollbackLines = 2 * MinScrollbackLines
   MaxCmdHistSize     = 2 * MinCmdHistSize
+  
+  ChatPosition = strings.ToLower(ChatPosition)
+  switch ChatPosition {
+  case "top", "right", "off", "":
+  default:
+    fmt.Printf("Bad CHAT_PANE setting %q (should be top, right, or off)\n",
+               ChatPosition)
+    ChatPosition = "off"
+  }
+  
+  NotifyEscape = strings.ToLower(NotifyEscape)
+  switch NotifyEscape {
+  case "9", "777", "both":
+  default:
+    fmt.Printf("Bad NOTIFY_ESCAPE setting %q (should be 9, 777, or both)\n",
+               NotifyEscape)
+    NotifyEscape = "777"
+  }
+  
+  SetUse256()
+  for _, cs := range ColorSettings {
+    if cs.Val != "" {
+      if _, err := ParseColor(cs.Val); err != nil {
+        fmt.Printf("Bad %s setting %q: %s\n", strings.ToUpper(cs.Key), cs.Val, err)
+        cs.Val = ""
+      }
+    }
+  }
+  if err := ApplyColors(Theme); err != nil {
+    fmt.Printf("Error loading theme: %s\n", err)
+    Theme = ""
+    ApplyColors(Theme)
+  }
+  if err := BuildSpeakerColors(); err != nil {
+    fmt.Printf("Bad SPEAKER_COLORS setting: %s\n", err)
+  }
+  if err := BuildSpeechRe(); err != nil {
+    fmt.Printf("Bad SPEECH_PATTERN setting: %s\n", err)
+  }
+  
+  LoadRules()
 }
 
-// Tear down the termbox display and write any logout messages to stdout.
+// Tear down the termbox display, put back the terminal's title, close (and
+// maybe delete) the scrollback store, and write any logout messages to
+// stdout.
 //
 func Finalize() {
   termbox.Close()
+  RestoreTitle()
+  if ScrollStore != nil {
+    ScrollStore.Close(KeepScrollback)
+  }
+  CloseGameLog()
   for _, m := range LogoutMessages {
     fmt.Printf("\n%s\n", m)
   }
@@ -881,6 +4978,7 @@ func getPassword() (string, error) {
     panic(err)
   }
   defer termbox.Close()
+  SetOutputMode()
   
   pwd_chars := make([]rune, 0, 0)
   prompt := "Password: "
@@ -890,13 +4988,13 @@ func getPassword() (string, error) {
     w, h := termbox.Size()
     y := h-1
     for n, r := range prompt {
-      termbox.SetCell(n, y, r, DefaultFg, DefaultBg)
+      termbox.SetCell(n, y, r, InputFg, InputBg)
     }
     for n, _ := range pwd_chars {
-      termbox.SetCell(n+lp, y, '*', DefaultFg, DefaultBg)
+      termbox.SetCell(n+lp, y, '*', InputFg, InputBg)
     }
     for x := lp + len(pwd_chars); x < w; x++ {
-      termbox.SetCell(x, y, ' ', DefaultFg, DefaultBg)
+      termbox.SetCell(x, y, ' ', InputFg, InputBg)
     }
     termbox.Flush()
     
@@ -959,6 +5057,8 @@ func main() {
   } else {
     uname = Uname
   }
+  CharName = uname
+  AddNameAlert(CharName)
   if Pwd == "" {
     pwd, err = getPassword()
     if err != nil {
@@ -1003,20 +5103,22 @@ func main() {
   }
   defer Finalize()  // includes call to termbox.Close()
   log.Println("termbox initialized")
+  SetOutputMode()
   
-  termbox.SetInputMode(termbox.InputAlt)
+  SetMouseCapture(MouseCapture)
   
   HeadLine = NewLine("", DefaultFg, DefaultBg)
   FootLine = NewLine("", DefaultFg, DefaultBg)
+  StartTitle()
   
   {
     x, y := termbox.Size()
     Redimension(x, y)
     Recalculate()
-    DrawHeadLine()
-    DrawScrollback()
-    DrawFootline()
-    DrawInput()
+    RedrawAll()
+  }
+  if Logging {
+    StartLogging()
   }
   
   // Launch our goroutines which listen for messages from the game and
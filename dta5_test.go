@@ -0,0 +1,627 @@
+package main
+
+// Tests, and benchmarks for drawing and scrolling the game window. The
+// benchmarks should take time proportional to the size of the window, not
+// the length of the history; run them with "go test -bench ." and compare
+// the 1k and 1M line results. (Set DTA5_SCALE_TEST=1 to have "go test"
+// check that, too.)
+
+import( "fmt"; "io/ioutil"; "log"; "os"; "strings"; "testing"; "time";
+        "github.com/nsf/termbox-go";
+)
+
+// Returns a function that puts the game window history (and the other
+// things benchHistory() changes) back the way they are now.
+//
+func keepHistory() func() {
+  lines, base, store := Lines, LineBase, ScrollStore
+  min_lines, max_lines := MinScrollbackLines, MaxScrollbackLines
+  types, name := ViewTypes, ViewName
+  w, h := TermW, TermH
+  return func() {
+    Lines, LineBase, ScrollStore = lines, base, store
+    MinScrollbackLines, MaxScrollbackLines = min_lines, max_lines
+    ViewTypes, ViewName = types, name
+    BuildViewIndex()
+    ViewLine, ViewRow = -1, 0
+    UnreadFrom, UnreadLines, MarkerIdx = -1, 0, -1
+    TermW, TermH = w, h
+    Recalculate()
+  }
+}
+
+// Replace the game window's history with n (in-memory) Lines, long enough
+// that some of them wrap, and lay out an 80x40 terminal. Every thousandth
+// Line is speech; the rest are "txt".
+//
+func benchHistory(n int) {
+  log.SetOutput(ioutil.Discard)
+  Lines = make([]*Line, 0, n)
+  for i := 0; i < n; i++ {
+    l := NewLine(fmt.Sprintf(
+      "line %d of the history, with enough words in it to wrap around the right edge of the window", i),
+      DefaultFg, DefaultBg)
+    l.Type = "txt"
+    if i % 1000 == 0 {
+      l.Type = "speech"
+    }
+    Lines = append(Lines, l)
+  }
+  MinScrollbackLines, MaxScrollbackLines = n, 2 * n + 2
+  LineBase, ScrollStore = 0, nil
+  ViewLine, ViewRow = -1, 0
+  UnreadFrom, UnreadLines, MarkerIdx = -1, 0, -1
+  ViewTypes, ViewName = nil, "all"
+  BuildViewIndex()
+  HeadLine = NewLine("", DefaultFg, DefaultBg)
+  FootLine = NewLine("", DefaultFg, DefaultBg)
+  TermW, TermH = 80, 40
+  Recalculate()
+}
+
+var benchSizes = []int{ 1000, 1000000 }
+
+// Redrawing the newest text.
+//
+func BenchmarkDrawScrollback(b *testing.B) {
+  defer keepHistory()()
+  for _, n := range benchSizes {
+    benchHistory(n)
+    b.Run(fmt.Sprintf("lines=%d", n), func(b *testing.B) {
+      for i := 0; i < b.N; i++ {
+        DrawScrollback()
+      }
+    })
+  }
+}
+
+// Redrawing halfway back through the history, at a different width each
+// time (like while the terminal is being resized), so the visible Lines
+// have to be rewrapped.
+//
+func BenchmarkDrawScrolledBack(b *testing.B) {
+  defer keepHistory()()
+  for _, n := range benchSizes {
+    benchHistory(n)
+    b.Run(fmt.Sprintf("lines=%d", n), func(b *testing.B) {
+      for i := 0; i < b.N; i++ {
+        TextW = 60 + i % 20
+        ScrollTo(n / 2, 0)
+        DrawScrollback()
+      }
+    })
+  }
+}
+
+// Redrawing halfway back through the history when only speech (one Line in
+// a thousand) is being shown.
+//
+func BenchmarkDrawFiltered(b *testing.B) {
+  defer keepHistory()()
+  for _, n := range benchSizes {
+    benchHistory(n)
+    SetView("speech", map[string]bool{ "speech": true })
+    b.Run(fmt.Sprintf("lines=%d", n), func(b *testing.B) {
+      for i := 0; i < b.N; i++ {
+        ScrollTo(n / 2, 0)
+        DrawScrollback()
+      }
+    })
+  }
+}
+
+// The row arithmetic PgUp and PgDn are built on.
+//
+func BenchmarkScrollRows(b *testing.B) {
+  defer keepHistory()()
+  for _, n := range benchSizes {
+    benchHistory(n)
+    b.Run(fmt.Sprintf("lines=%d", n), func(b *testing.B) {
+      for i := 0; i < b.N; i++ {
+        lidx, row := NewestRow()
+        lidx, row = RowsBack(lidx, row, 3 * HistoryRows())
+        lidx, row = RowsForward(lidx, row, HistoryRows())
+        ScrollTo(lidx, row)
+      }
+    })
+  }
+}
+
+// Fails if redrawing a million-line history takes much longer than
+// redrawing a thousand-line one (which it would if drawing looked at the
+// whole history instead of just what's on screen). Being a timing test,
+// it's slow and at the mercy of whatever else the machine is doing, so it
+// only runs if DTA5_SCALE_TEST is set.
+//
+func TestDrawScrollbackScales(t *testing.T) {
+  if os.Getenv("DTA5_SCALE_TEST") == "" {
+    t.Skip("set DTA5_SCALE_TEST=1 to run")
+  }
+  defer keepHistory()()
+  per_op := make([]int64, 0, len(benchSizes))
+  for _, n := range benchSizes {
+    benchHistory(n)
+    ScrollTo(n / 2, 0)
+    r := testing.Benchmark(func(b *testing.B) {
+      for i := 0; i < b.N; i++ {
+        DrawScrollback()
+      }
+    })
+    per_op = append(per_op, r.NsPerOp())
+  }
+  if per_op[1] > 20 * per_op[0] + 1000 {
+    t.Errorf("redraw took %d ns with %d Lines but %d ns with %d Lines",
+             per_op[0], benchSizes[0], per_op[1], benchSizes[1])
+  }
+}
+
+// Returns how a differs from b (in the things the scrollback store keeps),
+// or "" if it doesn't.
+//
+func lineDiff(a, b *Line) string {
+  if a.Pre != b.Pre || a.Type != b.Type || !a.Time.Equal(b.Time) {
+    return fmt.Sprintf("Pre/Type/Time %v/%q/%v, want %v/%q/%v",
+                       a.Pre, a.Type, a.Time, b.Pre, b.Type, b.Time)
+  }
+  if len(a.C) != len(b.C) {
+    return fmt.Sprintf("%d Cells (%q), want %d (%q)", len(a.C), a.String(),
+                       len(b.C), b.String())
+  }
+  for n := range a.C {
+    if a.C[n] != b.C[n] {
+      return fmt.Sprintf("Cell %d is %+v, want %+v", n, a.C[n], b.C[n])
+    }
+  }
+  return ""
+}
+
+// Lines to store and read back, covering the different parts of a record.
+//
+func storeCases() map[string]*Line {
+  stamp := time.Date(2017, 8, 25, 13, 14, 15, 16, time.Local)
+  cases := map[string]*Line{
+    "empty":   NewLine("", DefaultFg, DefaultBg),
+    "plain":   NewLine("You are in a maze of twisty little passages.",
+                       DefaultFg, DefaultBg),
+    "wide":    NewLine("漢字 and ünïcödé, 🐉!",
+                       termbox.ColorCyan, termbox.ColorBlack),
+    "colors":  NewLine("red, then bold 256-color", DefaultFg, DefaultBg),
+    "stamped": NewLine("stamped", DefaultFg, DefaultBg),
+    "pre":     NewLine("+--+\t|  |", DefaultFg, DefaultBg),
+    "speech":  NewLine(`Bob says, "hi"`, DefaultFg, DefaultBg),
+  }
+  cases["colors"].Colorize(0, 3, DefaultFg, DefaultBg,
+                           termbox.ColorRed, termbox.ColorDefault)
+  cases["colors"].Colorize(10, 24, DefaultFg, DefaultBg,
+    termbox.Attribute(203) | termbox.AttrBold | termbox.AttrUnderline,
+    termbox.Attribute(18))
+  cases["stamped"].Time = stamp
+  cases["pre"].Pre = true
+  cases["pre"].Time = stamp
+  cases["speech"].Type = "speech"
+  return cases
+}
+
+// Every case should come back from EncodeLine() and DecodeLine() unchanged.
+//
+func TestEncodeLineRoundTrip(t *testing.T) {
+  for name, l := range storeCases() {
+    got, err := DecodeLine(EncodeLine(nil, l))
+    if err != nil {
+      t.Errorf("%s: %s", name, err)
+    } else if d := lineDiff(got, l); d != "" {
+      t.Errorf("%s: %s", name, d)
+    }
+  }
+}
+
+// Truncated or corrupt records should be errors, not panics or garbage.
+//
+func TestDecodeLineBadRecords(t *testing.T) {
+  rec := EncodeLine(nil, storeCases()["colors"])
+  runs := rec[:len(rec) - len("256-color")]
+  bad := map[string][]byte{
+    "empty":           []byte{},
+    "no time":         rec[:1],
+    "type too long":   []byte{ 0, 0, 50, 'x' },
+    "truncated run":   rec[:len(rec) - 3],
+    "truncated color": append(append([]byte{}, runs...), 0x80),
+  }
+  for name, r := range bad {
+    if _, err := DecodeLine(r); err == nil {
+      t.Errorf("%s: no error", name)
+    }
+  }
+}
+
+// Lines spilled from Lines to a scrollback store should read back the same,
+// whether from the store's cache or from its file.
+//
+func TestLineStoreSpill(t *testing.T) {
+  defer keepHistory()()
+  store, dir := StoreScrollback, ScrollbackDir
+  defer func() { StoreScrollback, ScrollbackDir = store, dir }()
+  log.SetOutput(ioutil.Discard)
+  StoreScrollback, ScrollbackDir = true, t.TempDir()
+  Lines, LineBase, ScrollStore = make([]*Line, 0, 0), 0, nil
+  MinScrollbackLines, MaxScrollbackLines = 4, 8
+
+  cases := storeCases()
+  names := make([]string, 0, len(cases))
+  for name, l := range cases {
+    names = append(names, name)
+    AddLine(l)
+  }
+  for n := 0; n < 20; n++ {
+    AddLine(NewLine(fmt.Sprintf("filler %d", n), DefaultFg, DefaultBg))
+  }
+  if ScrollStore == nil || ScrollStore.Len() < len(cases) {
+    t.Fatalf("Lines weren't spilled to the store")
+  }
+  defer func() {
+    ScrollStore.Close(false)
+    ScrollStore = nil
+  }()
+  for n, name := range names {
+    if d := lineDiff(GetLine(n), cases[name]); d != "" {
+      t.Errorf("%s: %s", name, d)
+    }
+    // Read it from the file again, not the cache.
+    ScrollStore.cache = make(map[int]*Line)
+    if d := lineDiff(GetLine(n), cases[name]); d != "" {
+      t.Errorf("%s (uncached): %s", name, d)
+    }
+  }
+}
+
+// Text with SGR (and other) escape sequences, and what the last Cell of the
+// Line made from it should look like, starting from white on black.
+//
+var sgrCases = []struct{
+  name, text, want string
+  use256         bool
+  fg, bg         termbox.Attribute
+}{
+  { "plain", "x", "x", false, termbox.ColorWhite, termbox.ColorBlack },
+  { "red", "\x1b[31mx", "x", false, termbox.ColorRed, termbox.ColorBlack },
+  { "bold red", "\x1b[1;31mx", "x", false,
+    termbox.ColorRed | termbox.AttrBold, termbox.ColorBlack },
+  { "bright", "\x1b[94;103mx", "x", false,
+    termbox.ColorLightBlue, termbox.ColorLightYellow },
+  { "underline reverse", "\x1b[4;7mx", "x", false,
+    termbox.ColorWhite | termbox.AttrUnderline | termbox.AttrReverse,
+    termbox.ColorBlack },
+  { "attributes off", "\x1b[1;4;7;31m\x1b[22;24;27mx", "x", false,
+    termbox.ColorRed, termbox.ColorBlack },
+  { "reset", "\x1b[1;31;44m\x1b[0mx", "x", false,
+    termbox.ColorWhite, termbox.ColorBlack },
+  { "empty reset", "\x1b[1;31;44m\x1b[mx", "x", false,
+    termbox.ColorWhite, termbox.ColorBlack },
+  { "default colors", "\x1b[1;31;44m\x1b[39;49mx", "x", false,
+    termbox.ColorWhite | termbox.AttrBold, termbox.ColorBlack },
+  { "unknown code", "\x1b[31;99mx", "x", false,
+    termbox.ColorRed, termbox.ColorBlack },
+  { "256 fg", "\x1b[38;5;208mx", "x", true,
+    termbox.Attribute(209), termbox.ColorBlack },
+  { "256 bg", "\x1b[48;5;17mx", "x", true,
+    termbox.ColorWhite, termbox.Attribute(18) },
+  { "256 colons", "\x1b[38:5:208mx", "x", true,
+    termbox.Attribute(209), termbox.ColorBlack },
+  { "256 low in 16", "\x1b[38;5;9mx", "x", false,
+    termbox.ColorLightRed, termbox.ColorBlack },
+  { "256 out of range", "\x1b[38;5;300mx", "x", true,
+    termbox.ColorDefault, termbox.ColorBlack },
+  { "rgb", "\x1b[38;2;255;135;0mx", "x", true,
+    termbox.Attribute(209), termbox.ColorBlack },
+  { "rgb bg", "\x1b[1;48;2;0;0;95mx", "x", true,
+    termbox.ColorWhite | termbox.AttrBold, termbox.Attribute(18) },
+  { "truncated 38;5", "\x1b[1;38;5mx", "x", true,
+    termbox.ColorWhite | termbox.AttrBold, termbox.ColorBlack },
+  { "truncated 38;2", "\x1b[31m\x1b[38;2;1;2mx", "x", true,
+    termbox.ColorRed, termbox.ColorBlack },
+  { "bad parameter", "\x1b[31m\x1b[1;zmx", "mx", false,
+    termbox.ColorRed, termbox.ColorBlack },
+  { "not a number", "\x1b[31m\x1b[1;<5mx", "x", false,
+    termbox.ColorRed, termbox.ColorBlack },
+  { "other final byte", "\x1b[31Hx", "x", false,
+    termbox.ColorWhite, termbox.ColorBlack },
+  { "intermediate byte", "\x1b[31 mx", "x", false,
+    termbox.ColorRed, termbox.ColorBlack },
+  { "unterminated CSI", "x\x1b[31", "x", false,
+    termbox.ColorWhite, termbox.ColorBlack },
+  { "lone ESC", "x\x1b", "x", false, termbox.ColorWhite, termbox.ColorBlack },
+  { "OSC", "\x1b]0;title\x07x", "x", false,
+    termbox.ColorWhite, termbox.ColorBlack },
+  { "OSC with ST", "\x1b]0;title\x1b\\x", "x", false,
+    termbox.ColorWhite, termbox.ColorBlack },
+  { "unterminated OSC", "x\x1b]0;title", "x", false,
+    termbox.ColorWhite, termbox.ColorBlack },
+  { "two-character escape", "\x1b7x", "x", false,
+    termbox.ColorWhite, termbox.ColorBlack },
+  { "control characters", "\x07\x00x\x08", "x", false,
+    termbox.ColorWhite, termbox.ColorBlack },
+}
+
+func TestSGRState(t *testing.T) {
+  use256 := Use256
+  defer func() { Use256 = use256 }()
+  for _, c := range sgrCases {
+    Use256 = c.use256
+    l := NewSGRState(termbox.ColorWhite, termbox.ColorBlack).NewLine(c.text)
+    if l.String() != c.want {
+      t.Errorf("%s: text %q, want %q", c.name, l.String(), c.want)
+      continue
+    }
+    last := l.C[len(l.C)-1]
+    if last.Fg != c.fg || last.Bg != c.bg {
+      t.Errorf("%s: colors %#x/%#x, want %#x/%#x",
+               c.name, last.Fg, last.Bg, c.fg, c.bg)
+    }
+  }
+}
+
+// Colors set on one line carry on to the next, until they're reset; Append()
+// continues from where the last one left off.
+//
+func TestSGRStateCarriesOver(t *testing.T) {
+  s := NewSGRState(termbox.ColorWhite, termbox.ColorBlack)
+  s.NewLine("\x1b[1;32mgreen")
+  l := s.NewLine("still green")
+  if l.C[0].Fg != termbox.ColorGreen | termbox.AttrBold {
+    t.Errorf("second line's color %#x, want bold green", l.C[0].Fg)
+  }
+  l.C = s.Append(l.C, "\x1b[0m, now white")
+  if c := l.C[len(l.C)-1]; c.Fg != termbox.ColorWhite ||
+                            c.Bg != termbox.ColorBlack {
+    t.Errorf("after reset, colors %#x/%#x, want white on black", c.Fg, c.Bg)
+  }
+  if l.String() != "still green, now white" {
+    t.Errorf("text %q", l.String())
+  }
+}
+
+// Foreground colors for the letters in markupCases' want_fg.
+//
+var markupFg = map[byte]termbox.Attribute{
+  'n': termbox.ColorWhite,
+  'b': termbox.ColorWhite | termbox.AttrBold,
+  'u': termbox.ColorWhite | termbox.AttrUnderline,
+  'c': termbox.ColorWhite | termbox.AttrCursive,
+  'r': termbox.ColorRed,
+  'R': termbox.ColorRed | termbox.AttrBold,
+}
+
+// Text with markup tags, the text that should be shown, and the foreground
+// of each of its Cells (as letters from markupFg, or 'i' and 'p' for
+// ItemFg and PlayerFg), starting from white on black.
+//
+var markupCases = []struct{ text, want, want_fg string }{
+  { "a{b}bc{/b}d", "abcd", "nbbn" },
+  { "{b}a{/}b", "ab", "bn" },
+  { "{u}a{/u}{i}b", "ab", "uc" },
+  { "{c:red}a{/c}b", "ab", "rn" },
+  { "{b}{c:red}a{/}b{/}c", "abc", "Rbn" },
+  { "{b}a{c:red}b{/b}c", "abc", "bRn" },
+  { "{c:hot}a", "a", "R" },
+  { "{item}axe{/item} {player}Bo{/player}", "axe Bo", "iiinpp" },
+  { "{B}a{/B}b", "ab", "bn" },
+  { "{ b }a", "a", "b" },
+  { "{b}\x1b[31ma{/b}b", "ab", "Rn" },
+  { "{{b}a", "{b}a", "nnnn" },
+  { "{/b}a", "a", "n" },
+  { "{/x}a", "{/x}a", "nnnnn" },
+  { "{blink}a", "{blink}a", "nnnnnnnn" },
+  { "{c:bogus}a", "{c:bogus}a", "nnnnnnnnnn" },
+  { "{b}a{b", "a{b", "bbb" },
+  { "{c:" + strings.Repeat("x", 40) + "}",
+    "{c:" + strings.Repeat("x", 40) + "}", strings.Repeat("n", 44) },
+}
+
+func TestMarkupTags(t *testing.T) {
+  ColorAliases["hot"] = "red bold"
+  defer delete(ColorAliases, "hot")
+  for _, c := range markupCases {
+    l := NewMarkupState(termbox.ColorWhite, termbox.ColorBlack).NewLine(c.text)
+    if l.String() != c.want {
+      t.Errorf("%q: text %q, want %q", c.text, l.String(), c.want)
+      continue
+    }
+    for n, cell := range l.C {
+      want := markupFg[c.want_fg[n]]
+      switch c.want_fg[n] {
+      case 'i':
+        want = ItemFg
+      case 'p':
+        want = PlayerFg
+      }
+      if cell.Fg != want || cell.Bg != termbox.ColorBlack {
+        t.Errorf("%q: Cell %d colors %#x/%#x, want %#x/%#x", c.text, n,
+                 cell.Fg, cell.Bg, want, termbox.ColorBlack)
+        break
+      }
+    }
+  }
+}
+
+// A tag left open stays open on the following lines, until it's closed.
+//
+func TestMarkupUnclosed(t *testing.T) {
+  s := NewMarkupState(termbox.ColorWhite, termbox.ColorBlack)
+  s.NewLine("{b}{c:red}unclosed")
+  if l := s.NewLine("x"); l.C[0].Fg != termbox.ColorRed | termbox.AttrBold {
+    t.Errorf("next line's color %#x, want bold red", l.C[0].Fg)
+  }
+  if l := s.NewLine("{/c}x{/}y"); l.C[0].Fg != markupFg['b'] ||
+                                  l.C[1].Fg != markupFg['n'] {
+    t.Errorf("after closing, colors %#x, %#x, want bold white, white",
+             l.C[0].Fg, l.C[1].Fg)
+  }
+}
+
+// Returns a function that puts the wrapping settings back the way they are
+// now, after setting them to their defaults.
+//
+func keepWrapping() func() {
+  log.SetOutput(ioutil.Discard)
+  preserve, hanging, tab := PreserveIndent, HangingIndent, TabWidth
+  PreserveIndent, HangingIndent, TabWidth = true, 0, 8
+  return func() {
+    PreserveIndent, HangingIndent, TabWidth = preserve, hanging, tab
+  }
+}
+
+// Returns the text of each row of the Line wrapped to the given width.
+//
+func wrapRows(l *Line, width int) []string {
+  l.Wrap(width)
+  rows := make([]string, len(l.Starts))
+  for n := range l.Starts {
+    rows[n] = Line{ C: l.C[l.Starts[n]:l.Ends[n]] }.String()
+  }
+  return rows
+}
+
+func TestFitCells(t *testing.T) {
+  l := NewLine("ab日本c", DefaultFg, DefaultBg)
+  for _, c := range []struct{ pos, width, want int }{
+    { 0, 2, 2 },
+    { 0, 3, 2 },   // 日 would stick out past the edge
+    { 0, 4, 3 },
+    { 0, 0, 1 },   // something always fits
+    { 2, 1, 3 },   // even a wide rune in a one-column row
+    { 2, 3, 3 },
+    { 2, 4, 4 },
+    { 3, 10, 5 },
+    { 5, 3, 5 },
+  } {
+    if got := l.fitCells(c.pos, c.width); got != c.want {
+      t.Errorf("fitCells(%d, %d) = %d, want %d", c.pos, c.width, got, c.want)
+    }
+  }
+}
+
+// Wrapping Lines with double-width characters in them. (CJK text can break
+// between any two characters.)
+//
+func TestWrapWideRunes(t *testing.T) {
+  defer keepWrapping()()
+  for _, c := range []struct{
+    text  string
+    width int
+    want  []string
+  }{
+    { "日本語日本語日本語", 5,
+      []string{ "日本", "語日", "本語", "日本", "語" } },
+    { "日", 1, []string{ "日" } },
+    { "日本", 1, []string{ "日", "本" } },
+    { "abc日", 4, []string{ "abc", "日" } },
+    { "日本 語", 5, []string{ "日本", "語" } },
+    { "ab 日本語 cd", 6, []string{ "ab 日", "本語", "cd" } },
+  } {
+    got := wrapRows(NewLine(c.text, DefaultFg, DefaultBg), c.width)
+    if fmt.Sprint(got) != fmt.Sprint(c.want) {
+      t.Errorf("%q at width %d: %q, want %q",
+               c.text, c.width, got, c.want)
+    }
+  }
+}
+
+// However it's wrapped, every row should fit in the width (unless it's a
+// single Cell), and no text should go missing.
+//
+func TestWrapFits(t *testing.T) {
+  defer keepWrapping()()
+  text := "café 日本語のテキストです and ＦＵＬＬＷＩＤＴＨ 🐉 dragons"
+  for width := 1; width <= 40; width++ {
+    l := NewLine(text, DefaultFg, DefaultBg)
+    rows := wrapRows(l, width)
+    for n := range rows {
+      cols := CellCols(l.C[l.Starts[n]:l.Ends[n]])
+      if n > 0 {
+        cols = cols + l.Indent
+      }
+      if cols > width && l.Ends[n] - l.Starts[n] > 1 {
+        t.Errorf("width %d: row %d (%q) is %d columns",
+                 width, n, rows[n], cols)
+      }
+    }
+    squeeze := func(s string) string { return strings.Replace(s, " ", "", -1) }
+    if squeeze(strings.Join(rows, "")) != squeeze(text) {
+      t.Errorf("width %d: rows %q", width, rows)
+    }
+  }
+}
+
+// Tabs are expanded to the next tab stop, counting columns rather than
+// Cells, and not counting escape sequences.
+//
+func TestTabStops(t *testing.T) {
+  defer keepWrapping()()
+  for _, c := range []struct{
+    text      string
+    tab_width int
+    want      string
+  }{
+    { "a\tb\t\tc", 8, "a       b               c" },
+    { "\tx", 8, "        x" },
+    { "12345678\tx", 8, "12345678        x" },
+    { "日本\tx", 8, "日本    x" },
+    { "\x1b[31ma\x1b[0m\tb", 8, "a       b" },
+    { "a\tb", 4, "a   b" },
+    { "abcd\tb", 4, "abcd    b" },
+    { "a\tb", 0, "a b" },
+  } {
+    TabWidth = c.tab_width
+    if got := StripANSI(c.text); got != c.want {
+      t.Errorf("%q with TabWidth %d: %q, want %q",
+               c.text, c.tab_width, got, c.want)
+    }
+  }
+}
+
+// Indentation of the rows after the first.
+//
+func TestWrapIndent(t *testing.T) {
+  defer keepWrapping()()
+  deep := strings.Repeat(" ", 20)
+  for _, c := range []struct{
+    text        string
+    width       int
+    preserve    bool
+    hanging     int
+    pre         bool
+    want_indent int
+    want        []string
+  }{
+    // The first row keeps its indentation, and the rest match it.
+    { "    * one two three four five six", 16, true, 0, false, 4,
+      []string{ "    * one two", "three four", "five six" } },
+    { "    * one two three four five six", 16, false, 0, false, 0,
+      []string{ "* one two three", "four five six" } },
+    { "aaa bbb ccc ddd eee fff", 20, true, 2, false, 2,
+      []string{ "aaa bbb ccc ddd eee", "fff" } },
+    { "  aaa bbb ccc ddd eee fff", 20, true, 2, false, 4,
+      []string{ "  aaa bbb ccc ddd", "eee fff" } },
+    // Indentation is limited to half the width...
+    { deep + "aaaa bbbb cccc dddd", 30, true, 0, false, 15,
+      []string{ deep + "aaaa bbbb", "cccc dddd" } },
+    // ...and dropped if it'd leave fewer than MinWrapCols.
+    { "aaa bbb ccc ddd eee", 8, true, 2, false, 0,
+      []string{ "aaa bbb", "ccc ddd", "eee" } },
+    { "            deep indent text that wraps", 16, true, 0, false, 0,
+      []string{ "deep indent", "text that wraps" } },
+    { "   ", 8, true, 0, false, 0, []string{ "" } },
+    // Pre Lines aren't wrapped at all.
+    { "    pre text longer than the width", 10, true, 2, true, 0,
+      []string{ "    pre text longer than the width" } },
+  } {
+    PreserveIndent, HangingIndent = c.preserve, c.hanging
+    l := NewLine(c.text, DefaultFg, DefaultBg)
+    l.Pre = c.pre
+    got := wrapRows(l, c.width)
+    if fmt.Sprint(got) != fmt.Sprint(c.want) || l.Indent != c.want_indent {
+      t.Errorf("%q at width %d: %q indented %d, want %q indented %d",
+               c.text, c.width, got, l.Indent, c.want, c.want_indent)
+    }
+  }
+}